@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// truncatedMarker is appended to a logged body which was cut at the configured limit
+const truncatedMarker = "...[truncated]"
+
+// defaultBodyContentTypes lists textual content types which are logged when WithBodyLogging is called without any.
+// An entry ending with "/" or "/*" matches the whole type, an entry starting with "+" matches a structured syntax suffix.
+var defaultBodyContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/xml",
+	"application/x-www-form-urlencoded",
+	"application/javascript",
+	"application/graphql",
+	"+json",
+	"+xml",
+}
+
+// loggableContentType reports whether a body of the given Content-Type matches one of the allowed types
+func loggableContentType(contentType string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+		switch {
+		case strings.HasSuffix(a, "/*"):
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(a, "*")) {
+				return true
+			}
+		case strings.HasSuffix(a, "/"):
+			if strings.HasPrefix(mediaType, a) {
+				return true
+			}
+		case strings.HasPrefix(a, "+"):
+			if strings.HasSuffix(mediaType, a) {
+				return true
+			}
+		default:
+			if mediaType == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// formatBody returns the body as a string which is clearly marked when it was truncated
+func formatBody(body []byte, truncated bool) string {
+	if truncated {
+		return string(body) + truncatedMarker
+	}
+	return string(body)
+}
+
+// captureRequestBody wraps the request body to copy up to maxBytes of what the wrapped RoundTripper reads.
+// Nothing is read ahead, so a streaming body, e.g. a pipe whose producer waits for the response, is sent unchanged.
+// onClose is called once the RoundTripper closes the body, which it does when the body was sent or the request failed.
+// It returns a shallow copy of the request and true when the body is captured. The body is not captured when
+// the request has none or its content type should not be logged, a body without a Content-Type is captured
+// so the caller can sniff its type once it's decoded.
+func captureRequestBody(r *http.Request, maxBytes int64, contentTypes []string, onClose func(body []byte, truncated bool, read int64)) (*http.Request, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return r, false
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" && !loggableContentType(contentType, contentTypes) {
+		return r, false
+	}
+
+	// GetBody is left as it is, a body sent again by the RoundTripper is not captured
+	body := newBodyLogger(r.Body, maxBytes, onClose)
+	r = r.WithContext(r.Context())
+	r.Body = body
+	return r, true
+}
+
+// bodyLogger wraps a body and copies up to max bytes of what is read.
+// When the body is closed onClose is called once with the captured bytes and the number of bytes read.
+// A request body may be closed by the transport while it's being read, the capture stops once it's closed.
+type bodyLogger struct {
+	rc  io.ReadCloser
+	max int64
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+	read      int64
+	closed    bool
+
+	onClose func(body []byte, truncated bool, read int64)
+}
+
+func newBodyLogger(rc io.ReadCloser, max int64, onClose func(body []byte, truncated bool, read int64)) *bodyLogger {
+	return &bodyLogger{rc: rc, max: max, onClose: onClose}
+}
+
+func (b *bodyLogger) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return n, err
+	}
+	b.read += int64(n)
+	if n > 0 {
+		remaining := b.max - int64(b.buf.Len())
+		switch {
+		case remaining >= int64(n):
+			b.buf.Write(p[:n])
+		case remaining > 0:
+			b.buf.Write(p[:remaining])
+			b.truncated = true
+		default:
+			b.truncated = true
+		}
+	}
+	return n, err
+}
+
+func (b *bodyLogger) Close() error {
+	err := b.rc.Close()
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return err
+	}
+	b.closed = true
+	body, truncated, read := b.buf.Bytes(), b.truncated, b.read
+	b.mu.Unlock()
+
+	b.onClose(body, truncated, read)
+	return err
+}
+
+// captured returns the bytes captured so far, whether they were truncated and the number of bytes read
+func (b *bodyLogger) captured() ([]byte, bool, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes()), b.truncated, b.read
+}
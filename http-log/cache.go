@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache statuses of an exchange, they follow the Cache-Status header (RFC 9211)
+const (
+	CacheStatusHit         = "hit"         // a fresh stored response was served
+	CacheStatusMiss        = "miss"        // there was no usable stored response, the response came from the server
+	CacheStatusRevalidated = "revalidated" // the stored response was stale and the server confirmed it with a 304
+	CacheStatusStale       = "stale"       // a stale stored response was served, allowed by max-stale or stale-if-error
+	CacheStatusBypass      = "bypass"      // the request can't be served from the cache, e.g. a POST or no-store
+)
+
+// CacheTransport is a private HTTP cache (RFC 9111) storing the responses to GET requests.
+// It honours the Cache-Control and Expires freshness, revalidates stale responses with their ETag or Last-Modified,
+// matches the request headers listed by Vary and invalidates the stored response of a URL after an unsafe request.
+// Every response carries a Cache-Status header (RFC 9211), and the status is logged as cache_status
+// when CacheTransport is wrapped by a LoggingTransport (see WithRoundTripper).
+// A single response is stored per URL, a request whose Vary headers differ replaces it.
+// A response is stored once its body is read to the end or closed, closing it reads the rest of a body
+// up to the maximum entry size (see WithMaxCacheEntryBytes).
+type CacheTransport struct {
+	rt            http.RoundTripper
+	store         CacheStore
+	name          string
+	maxEntryBytes int64
+}
+
+func NewCacheTransport(options ...CacheOption) *CacheTransport {
+	t := &CacheTransport{
+		rt:            http.DefaultTransport,
+		name:          "http-log",
+		maxEntryBytes: 1 << 20,
+	}
+
+	for _, option := range options {
+		option(t)
+	}
+
+	if t.store == nil {
+		t.store = NewLRUCacheStore(64 << 20)
+	}
+	return t
+}
+
+type CacheOption func(transport *CacheTransport)
+
+func WithCacheRoundTripper(rt http.RoundTripper) CacheOption {
+	return func(t *CacheTransport) {
+		t.rt = rt
+	}
+}
+
+// WithCacheStore keeps the responses in the store, an in-memory LRU store of 64 MiB is used by default
+func WithCacheStore(store CacheStore) CacheOption {
+	return func(t *CacheTransport) {
+		t.store = store
+	}
+}
+
+// WithCacheName sets the name of the cache in the Cache-Status header, http-log by default
+func WithCacheName(name string) CacheOption {
+	return func(t *CacheTransport) {
+		t.name = name
+	}
+}
+
+// WithMaxCacheEntryBytes doesn't store responses whose body is larger than maxBytes, 1 MiB by default
+func WithMaxCacheEntryBytes(maxBytes int64) CacheOption {
+	return func(t *CacheTransport) {
+		t.maxEntryBytes = maxBytes
+	}
+}
+
+// cacheEntry is a stored response, it's kept in the store as JSON
+type cacheEntry struct {
+	StatusCode   int         `json:"status_code"`
+	Status       string      `json:"status"`
+	Proto        string      `json:"proto"`
+	Header       http.Header `json:"header"`
+	Body         []byte      `json:"body"`
+	RequestTime  time.Time   `json:"request_time"`
+	ResponseTime time.Time   `json:"response_time"`
+	// Vary keeps the values of the request headers listed by the Vary response header
+	Vary http.Header `json:"vary,omitempty"`
+}
+
+func (t *CacheTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	key := cacheKey(r.URL)
+	reqCC := parseCacheControl(r.Header)
+
+	if r.Method != http.MethodGet {
+		resp, err := t.rt.RoundTrip(r)
+		if err == nil && !isSafeMethod(r.Method) && resp.StatusCode < http.StatusBadRequest {
+			t.invalidate(r, resp)
+		}
+		return t.respond(r, resp, err, CacheStatusBypass, "fwd=bypass")
+	}
+	// conditional and range requests are the caller's own business
+	if reqCC.has("no-store") || r.Header.Get("Range") != "" || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		resp, err := t.rt.RoundTrip(r)
+		return t.respond(r, resp, err, CacheStatusBypass, "fwd=bypass")
+	}
+
+	entry := t.load(key, r)
+	if entry == nil {
+		if reqCC.has("only-if-cached") {
+			return t.respond(r, gatewayTimeout(r), nil, CacheStatusMiss, "fwd=miss")
+		}
+		return t.fetch(r, key, CacheStatusMiss, "fwd=miss")
+	}
+
+	now := time.Now()
+	age := entry.age(now)
+	lifetime := entry.freshnessLifetime()
+	respCC := parseCacheControl(entry.Header)
+	staleness := age - lifetime
+
+	if !reqCC.has("no-cache") && !respCC.has("no-cache") {
+		if staleness < 0 && reqCC.fresh(age, lifetime) {
+			return t.respond(r, entry.response(r, age), nil, CacheStatusHit, "hit; ttl="+ttl(lifetime-age))
+		}
+		if staleness >= 0 && !respCC.has("must-revalidate") && reqCC.acceptsStale(staleness) {
+			return t.respond(r, entry.response(r, age), nil, CacheStatusStale, "hit; ttl="+ttl(lifetime-age))
+		}
+	}
+	if reqCC.has("only-if-cached") {
+		return t.respond(r, gatewayTimeout(r), nil, CacheStatusMiss, "fwd=miss")
+	}
+
+	// revalidate the stale response, the caller's request must not be modified
+	conditional := r.Clone(r.Context())
+	etag := entry.Header.Get("ETag")
+	lastModified := entry.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return t.fetch(r, key, CacheStatusMiss, "fwd=stale")
+	}
+	if etag != "" {
+		conditional.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		conditional.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	requestTime := time.Now()
+	resp, err := t.rt.RoundTrip(conditional)
+	staleIfError := !respCC.has("must-revalidate") && (respCC.allowsStaleIfError(staleness) || reqCC.allowsStaleIfError(staleness))
+	switch {
+	case err != nil:
+		if staleIfError && r.Context().Err() == nil {
+			return t.respond(r, entry.response(r, age), nil, CacheStatusStale, "hit; ttl="+ttl(lifetime-age)+"; fwd=stale")
+		}
+		return t.respond(r, nil, err, CacheStatusMiss, "fwd=stale")
+	case resp.StatusCode == http.StatusNotModified:
+		drain(resp.Body)
+		entry.update(resp, requestTime, time.Now())
+		t.save(key, entry)
+		return t.respond(r, entry.response(r, entry.age(time.Now())), nil, CacheStatusRevalidated, "fwd=stale; fwd-status=304")
+	case resp.StatusCode >= http.StatusInternalServerError && staleIfError:
+		drain(resp.Body)
+		return t.respond(r, entry.response(r, age), nil, CacheStatusStale, "hit; ttl="+ttl(lifetime-age)+"; fwd=stale; fwd-status="+strconv.Itoa(resp.StatusCode))
+	}
+	resp = t.storeResponse(r, key, resp, requestTime)
+	return t.respond(r, resp, nil, CacheStatusMiss, "fwd=stale; fwd-status="+strconv.Itoa(resp.StatusCode))
+}
+
+// fetch forwards the request and stores the response when it's storable
+func (t *CacheTransport) fetch(r *http.Request, key, status, detail string) (*http.Response, error) {
+	requestTime := time.Now()
+	resp, err := t.rt.RoundTrip(r)
+	if err != nil {
+		return t.respond(r, nil, err, status, detail)
+	}
+	detail += "; fwd-status=" + strconv.Itoa(resp.StatusCode)
+	return t.respond(r, t.storeResponse(r, key, resp, requestTime), nil, status, detail)
+}
+
+// respond records the cache status for the LoggingTransport and adds this cache to the Cache-Status header
+func (t *CacheTransport) respond(r *http.Request, resp *http.Response, err error, status, detail string) (*http.Response, error) {
+	if reqInfo := requestInfoFromContext(r.Context()); reqInfo != nil {
+		reqInfo.muTrace.Lock()
+		reqInfo.CacheStatus = status
+		reqInfo.muTrace.Unlock()
+	}
+	if resp != nil {
+		// caches closer to the client come last
+		resp.Header.Add("Cache-Status", t.name+"; "+detail)
+	}
+	return resp, err
+}
+
+// storeResponse wraps the body so the response is stored once the caller read all of it
+func (t *CacheTransport) storeResponse(r *http.Request, key string, resp *http.Response, requestTime time.Time) *http.Response {
+	if !storable(r, resp) {
+		return resp
+	}
+	entry := &cacheEntry{
+		StatusCode:   resp.StatusCode,
+		Status:       resp.Status,
+		Proto:        resp.Proto,
+		Header:       resp.Header.Clone(),
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+		Vary:         varyHeaders(r, resp.Header),
+	}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		t.save(key, entry)
+		return resp
+	}
+	if resp.ContentLength > t.maxEntryBytes {
+		return resp
+	}
+	resp.Body = &cachingBody{ReadCloser: resp.Body, max: t.maxEntryBytes, store: func(body []byte) {
+		entry.Body = body
+		t.save(key, entry)
+	}}
+	return resp
+}
+
+func (t *CacheTransport) load(key string, r *http.Request) *cacheEntry {
+	data, ok := t.store.Get(key)
+	if !ok {
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.store.Delete(key)
+		return nil
+	}
+	for name, values := range entry.Vary {
+		if normalizeHeaderValues(r.Header.Values(name)) != normalizeHeaderValues(values) {
+			return nil
+		}
+	}
+	return &entry
+}
+
+func (t *CacheTransport) save(key string, entry *cacheEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	t.store.Set(key, data)
+}
+
+// invalidate removes the stored responses of the URL changed by an unsafe request, and of its Location
+// and Content-Location when they have the same origin
+func (t *CacheTransport) invalidate(r *http.Request, resp *http.Response) {
+	t.store.Delete(cacheKey(r.URL))
+	for _, name := range []string{"Location", "Content-Location"} {
+		if value := resp.Header.Get(name); value != "" {
+			if u, err := r.URL.Parse(value); err == nil && u.Scheme == r.URL.Scheme && u.Host == r.URL.Host {
+				t.store.Delete(cacheKey(u))
+			}
+		}
+	}
+}
+
+// cacheKey is the URL without its fragment
+func cacheKey(u *url.URL) string {
+	key := *u
+	key.Fragment = ""
+	key.RawFragment = ""
+	return key.String()
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// heuristicallyCacheable lists the status codes which may be stored without explicit freshness
+var heuristicallyCacheable = []int{200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501}
+
+// storable reports whether a private cache may store the response (RFC 9111 section 3)
+func storable(r *http.Request, resp *http.Response) bool {
+	if resp.StatusCode < 200 || resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	reqCC := parseCacheControl(r.Header)
+	respCC := parseCacheControl(resp.Header)
+	if reqCC.has("no-store") || respCC.has("no-store") {
+		return false
+	}
+	if slices.Contains(headerTokens(resp.Header, "Vary"), "*") {
+		return false
+	}
+	return respCC.has("max-age") || respCC.has("public") || respCC.has("private") || resp.Header.Get("Expires") != "" ||
+		slices.Contains(heuristicallyCacheable, resp.StatusCode)
+}
+
+// varyHeaders returns the request headers selected by the Vary header of the response
+func varyHeaders(r *http.Request, header http.Header) http.Header {
+	names := headerTokens(header, "Vary")
+	if len(names) == 0 {
+		return nil
+	}
+	vary := make(http.Header, len(names))
+	for _, name := range names {
+		vary[http.CanonicalHeaderKey(name)] = r.Header.Values(name)
+	}
+	return vary
+}
+
+func normalizeHeaderValues(values []string) string {
+	var parts []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// headerTokens returns the comma separated tokens of the header, lower cased
+func headerTokens(header http.Header, name string) []string {
+	var tokens []string
+	for _, value := range header.Values(name) {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.ToLower(strings.TrimSpace(token)); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// cacheControl holds the Cache-Control directives, a directive without a value maps to ""
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				cc[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+		}
+	}
+	// Pragma: no-cache is only honoured without Cache-Control
+	if len(cc) == 0 && slices.Contains(headerTokens(header, "Pragma"), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the delta-seconds argument of the directive
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	arg, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	s, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || s < 0 {
+		return 0, false
+	}
+	return time.Duration(s) * time.Second, true
+}
+
+// fresh reports whether the request's max-age and min-fresh accept a response of the given age
+func (cc cacheControl) fresh(age, lifetime time.Duration) bool {
+	if maxAge, ok := cc.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := cc.seconds("min-fresh"); ok && lifetime-age < minFresh {
+		return false
+	}
+	return true
+}
+
+// acceptsStale reports whether the request's max-stale accepts a response stale for the given duration
+func (cc cacheControl) acceptsStale(staleness time.Duration) bool {
+	arg, ok := cc["max-stale"]
+	if !ok {
+		return false
+	}
+	if arg == "" {
+		return true
+	}
+	maxStale, ok := cc.seconds("max-stale")
+	return ok && staleness <= maxStale
+}
+
+// allowsStaleIfError reports whether stale-if-error (RFC 5861) allows serving a response stale for the given duration
+func (cc cacheControl) allowsStaleIfError(staleness time.Duration) bool {
+	limit, ok := cc.seconds("stale-if-error")
+	return ok && staleness <= limit
+}
+
+// freshnessLifetime is how long the response stays fresh after it was generated (RFC 9111 section 4.2.1)
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if maxAge, ok := cc.seconds("max-age"); ok {
+		return maxAge
+	}
+	date := e.date()
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// an invalid Expires, e.g. 0, means already expired
+			return 0
+		}
+		return t.Sub(date)
+	}
+	// the heuristic freshness is 10% of the time since the last modification, capped at a day
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil &&
+		slices.Contains(heuristicallyCacheable, e.StatusCode) && lastModified.Before(date) {
+		return min(date.Sub(lastModified)/10, 24*time.Hour)
+	}
+	return 0
+}
+
+// date is the Date header, or the time the response was received without it
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.ResponseTime
+}
+
+// age is the current age of the response (RFC 9111 section 4.2.3)
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	var ageValue time.Duration
+	if age, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && age > 0 {
+		ageValue = time.Duration(age) * time.Second
+	}
+	apparentAge := max(e.ResponseTime.Sub(e.date()), 0)
+	responseDelay := e.ResponseTime.Sub(e.RequestTime)
+	correctedInitialAge := max(apparentAge, ageValue+responseDelay)
+	return correctedInitialAge + now.Sub(e.ResponseTime)
+}
+
+// update freshens the stored response with the headers of a 304 (RFC 9111 section 4.3.4)
+func (e *cacheEntry) update(resp *http.Response, requestTime, responseTime time.Time) {
+	for name, values := range resp.Header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range":
+			continue
+		}
+		e.Header[name] = values
+	}
+	e.RequestTime = requestTime
+	e.ResponseTime = responseTime
+}
+
+// response returns the stored response with its current Age
+func (e *cacheEntry) response(r *http.Request, age time.Duration) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	major, minor, ok := http.ParseHTTPVersion(e.Proto)
+	if !ok {
+		major, minor = 1, 1
+	}
+	return &http.Response{
+		Status:        e.Status,
+		StatusCode:    e.StatusCode,
+		Proto:         e.Proto,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       r,
+	}
+}
+
+// gatewayTimeout is the response to an only-if-cached request without a usable stored response
+func gatewayTimeout(r *http.Request) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout)),
+		StatusCode: http.StatusGatewayTimeout,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    r,
+	}
+}
+
+// ttl formats the remaining freshness of the Cache-Status header in seconds, negative when stale
+func ttl(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Floor(d.Seconds())), 10)
+}
+
+// drain reads the rest of the body so the connection can be reused
+func drain(body io.ReadCloser) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(body, 64<<10))
+	_ = body.Close()
+}
+
+// cachingBody copies the body while the caller reads it, store is called once when it's read to the end
+// and not larger than max. Close reads what is left up to max, a JSON decoder stops at the end of the value
+// and the response would never be stored otherwise.
+type cachingBody struct {
+	io.ReadCloser
+	max      int64
+	buf      bytes.Buffer
+	overflow bool
+	once     sync.Once
+	store    func(body []byte)
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.overflow {
+		b.buf.Write(p[:n])
+		if int64(b.buf.Len()) > b.max {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		}
+	}
+	if errors.Is(err, io.EOF) && !b.overflow {
+		b.once.Do(func() { b.store(bytes.Clone(b.buf.Bytes())) })
+	}
+	return n, err
+}
+
+func (b *cachingBody) Close() error {
+	if !b.overflow {
+		_, _ = io.Copy(io.Discard, io.LimitReader(b, b.max-int64(b.buf.Len())+1))
+	}
+	return b.ReadCloser.Close()
+}
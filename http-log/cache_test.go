@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheStep is a request sent through the cache and the outcome it must have
+type cacheStep struct {
+	method     string
+	header     http.Header
+	wantStatus string // the cache status logged for the exchange
+	wantCode   int
+	wantBody   string
+}
+
+// newCacheClient returns a client sending the requests through a LoggingTransport wrapping the cache
+func newCacheClient(store CacheStore) *http.Client {
+	cache := NewCacheTransport(WithCacheStore(store), WithCacheRoundTripper(http.DefaultTransport.(*http.Transport).Clone()))
+	return &http.Client{Transport: NewLoggingTransport(WithLogger(discardLogger()), WithRoundTripper(cache))}
+}
+
+// cacheDo sends the request of the step and returns the response, its body and the logged cache status
+func cacheDo(t *testing.T, client *http.Client, url string, step cacheStep) (*http.Response, string, string) {
+	t.Helper()
+	method := step.method
+	if method == "" {
+		method = http.MethodGet
+	}
+	ctx, capture := withRequestInfoCapture(t.Context())
+	r, _ := http.NewRequestWithContext(ctx, method, url, nil)
+	for name, values := range step.header {
+		r.Header[name] = values
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, resp)
+	if capture.reqInfo == nil {
+		t.Fatal("the LoggingTransport did not handle the request")
+	}
+	return resp, body, capture.reqInfo.CacheStatus
+}
+
+func TestCacheStatus(t *testing.T) {
+	cc := func(directives string) http.Header { return http.Header{"Cache-Control": {directives}} }
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+	tests := []struct {
+		name string
+		// respond answers the nth request of the origin, counting from 1
+		respond   func(w http.ResponseWriter, r *http.Request, n int)
+		steps     []cacheStep
+		wantCalls int
+	}{
+		{
+			name: "fresh hit",
+			respond: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				_, _ = io.WriteString(w, "v"+strconv.Itoa(n))
+			},
+			steps: []cacheStep{
+				{wantStatus: CacheStatusMiss, wantBody: "v1"},
+				{wantStatus: CacheStatusHit, wantBody: "v1"},
+				{wantStatus: CacheStatusHit, wantBody: "v1"},
+			},
+			wantCalls: 1,
+		},
+		{
+			name: "no-store response",
+			respond: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("Cache-Control", "no-store")
+				_, _ = io.WriteString(w, "v"+strconv.Itoa(n))
+			},
+			steps: []cacheStep{
+				{wantStatus: CacheStatusMiss, wantBody: "v1"},
+				{wantStatus: CacheStatusMiss, wantBody: "v2"},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "no-store and conditional requests bypass",
+			respond: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				_, _ = io.WriteString(w, "v"+strconv.Itoa(n))
+			},
+			steps: []cacheStep{
+				{header: cc("no-store"), wantStatus: CacheStatusBypass, wantBody: "v1"},
+				{header: http.Header{"If-None-Match": {`"x"`}}, wantStatus: CacheStatusBypass, wantBody: "v2"},
+				{header: http.Header{"Range": {"bytes=0-1"}}, wantStatus: CacheStatusBypass, wantBody: "v3"},
+			},
+			wantCalls: 3,
+		},
+		{
+			name: "no-cache request revalidates with ETag",
+			respond: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("ETag", `"v1"`)
+				if r.Header.Get("If-None-Match") == `"v1"` {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				_, _ = io.WriteString(w, "v"+strconv.Itoa(n))
+			},
+			steps: []cacheStep{
+				{wantStatus: CacheStatusMiss, wantBody: "v1"},
+				{header: cc("no-cache"), wantStatus: CacheStatusRevalidated, wantBody: "v1"},
+				{wantStatus: CacheStatusHit, wantBody: "v1"},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "stale response revalidated with Last-Modified",
+			respond: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("Last-Modified", lastModified)
+				if r.Header.Get("If-Modified-Since") == lastModified {
+					// the 304 makes the stored response fresh again
+					w.Header().Set("Cache-Control", "max-age=60")
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("Cache-Control", "max-age=0")
+				_, _ = io.WriteString(w, "v"+strconv.Itoa(n))
+			},
+			steps: []cacheStep{
+				{wantStatus: CacheStatusMiss, wantBody: "v1"},
+				{wantStatus: CacheStatusRevalidated, wantBody: "v1"},
+				{wantStatus: CacheStatusHit, wantBody: "v1"},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "stale response without validator is fetched again",
+			respond: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("Cache-Control", "max-age=0")
+				_, _ = io.WriteString(w, "v"+strconv.Itoa(n))
+			},
+			steps: []cacheStep{
+				{wantStatus: CacheStatusMiss, wantBody: "v1"},
+				{wantStatus: CacheStatusMiss, wantBody: "v2"},
+			},
+			wantCalls: 2,
+		},
+		{
+			// the Age header makes the response 9s stale when it's stored
+			name: "max-stale",
+			respond: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("Cache-Control", "max-age=1")
+				w.Header().Set("Age", "10")
+				_, _ = io.WriteString(w, "v"+strconv.Itoa(n))
+			},
+			steps: []cacheStep{
+				{wantStatus: CacheStatusMiss, wantBody: "v1"},
+				{header: cc("max-stale=60"), wantStatus: CacheStatusStale, wantBody: "v1"},
+				{header: cc("max-stale"), wantStatus: CacheStatusStale, wantBody: "v1"},
+				{header: cc("max-stale=5"), wantStatus: CacheStatusMiss, wantBody: "v2"},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "min-fresh and max-age of the request",
+			respond: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("Age", "30")
+				_, _ = io.WriteString(w, "v"+strconv.Itoa(n))
+			},
+			steps: []cacheStep{
+				{wantStatus: CacheStatusMiss, wantBody: "v1"},
+				{header: cc("min-fresh=10"), wantStatus: CacheStatusHit, wantBody: "v1"},
+				{header: cc("min-fresh=45"), wantStatus: CacheStatusMiss, wantBody: "v2"},
+				{header: cc("max-age=10"), wantStatus: CacheStatusMiss, wantBody: "v3"},
+			},
+			wantCalls: 3,
+		},
+		{
+			name: "stale-if-error",
+			respond: func(w http.ResponseWriter, r *http.Request, n int) {
+				if n > 1 {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Cache-Control", "max-age=0, stale-if-error=60")
+				w.Header().Set("ETag", `"v1"`)
+				_, _ = io.WriteString(w, "v1")
+			},
+			steps: []cacheStep{
+				{wantStatus: CacheStatusMiss, wantBody: "v1"},
+				{wantStatus: CacheStatusStale, wantBody: "v1"},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "must-revalidate forbids stale-if-error",
+			respond: func(w http.ResponseWriter, r *http.Request, n int) {
+				if n > 1 {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Cache-Control", "max-age=0, must-revalidate, stale-if-error=60")
+				w.Header().Set("ETag", `"v1"`)
+				_, _ = io.WriteString(w, "v1")
+			},
+			steps: []cacheStep{
+				{wantStatus: CacheStatusMiss, wantBody: "v1"},
+				{header: cc("max-stale"), wantStatus: CacheStatusMiss, wantCode: http.StatusInternalServerError},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "Vary",
+			respond: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("Vary", "Accept-Language")
+				_, _ = io.WriteString(w, r.Header.Get("Accept-Language")+strconv.Itoa(n))
+			},
+			steps: []cacheStep{
+				{header: http.Header{"Accept-Language": {"fr"}}, wantStatus: CacheStatusMiss, wantBody: "fr1"},
+				{header: http.Header{"Accept-Language": {"fr"}}, wantStatus: CacheStatusHit, wantBody: "fr1"},
+				{header: http.Header{"Accept-Language": {"de"}}, wantStatus: CacheStatusMiss, wantBody: "de2"},
+				{header: http.Header{"Accept-Language": {"fr"}}, wantStatus: CacheStatusMiss, wantBody: "fr3"},
+			},
+			wantCalls: 3,
+		},
+		{
+			name: "unsafe request invalidates",
+			respond: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				_, _ = io.WriteString(w, r.Method+strconv.Itoa(n))
+			},
+			steps: []cacheStep{
+				{wantStatus: CacheStatusMiss, wantBody: "GET1"},
+				{method: http.MethodPost, wantStatus: CacheStatusBypass, wantBody: "POST2"},
+				{wantStatus: CacheStatusMiss, wantBody: "GET3"},
+				{wantStatus: CacheStatusHit, wantBody: "GET3"},
+			},
+			wantCalls: 3,
+		},
+		{
+			name: "only-if-cached",
+			respond: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				_, _ = io.WriteString(w, "v"+strconv.Itoa(n))
+			},
+			steps: []cacheStep{
+				{header: cc("only-if-cached"), wantStatus: CacheStatusMiss, wantCode: http.StatusGatewayTimeout},
+				{wantStatus: CacheStatusMiss, wantBody: "v1"},
+				{header: cc("only-if-cached"), wantStatus: CacheStatusHit, wantBody: "v1"},
+			},
+			wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tt.respond(w, r, int(calls.Add(1)))
+			}))
+			defer srv.Close()
+			client := newCacheClient(NewLRUCacheStore(1 << 20))
+
+			for i, step := range tt.steps {
+				resp, body, status := cacheDo(t, client, srv.URL+"/resource", step)
+				wantCode := step.wantCode
+				if wantCode == 0 {
+					wantCode = http.StatusOK
+				}
+				if status != step.wantStatus || resp.StatusCode != wantCode || body != step.wantBody {
+					t.Errorf("request %d = %s %d %q, want %s %d %q", i+1, status, resp.StatusCode, body, step.wantStatus, wantCode, step.wantBody)
+				}
+				if resp.Header.Get("Cache-Status") == "" {
+					t.Errorf("request %d has no Cache-Status header", i+1)
+				}
+			}
+			if got := int(calls.Load()); got != tt.wantCalls {
+				t.Errorf("origin got %d requests, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCacheEntryFreshness(t *testing.T) {
+	responseTime := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	date := responseTime.Add(-5 * time.Second).Format(http.TimeFormat)
+
+	tests := []struct {
+		name         string
+		header       http.Header
+		requestTime  time.Time
+		wantLifetime time.Duration
+		wantAge      time.Duration
+	}{
+		{
+			name:         "max-age wins over Expires",
+			header:       http.Header{"Cache-Control": {"max-age=60"}, "Expires": {responseTime.Add(time.Hour).Format(http.TimeFormat)}},
+			wantLifetime: time.Minute,
+		},
+		{
+			name:         "Expires relative to Date",
+			header:       http.Header{"Date": {date}, "Expires": {responseTime.Add(55 * time.Second).Format(http.TimeFormat)}},
+			wantLifetime: time.Minute,
+			wantAge:      5 * time.Second,
+		},
+		{
+			name:         "invalid Expires",
+			header:       http.Header{"Expires": {"0"}},
+			wantLifetime: 0,
+		},
+		{
+			name:         "heuristic from Last-Modified",
+			header:       http.Header{"Last-Modified": {responseTime.Add(-100 * time.Hour).Format(http.TimeFormat)}},
+			wantLifetime: 10 * time.Hour,
+		},
+		{
+			name:         "heuristic capped at a day",
+			header:       http.Header{"Last-Modified": {responseTime.Add(-1000 * time.Hour).Format(http.TimeFormat)}},
+			wantLifetime: 24 * time.Hour,
+		},
+		{
+			name:         "Age and response delay",
+			header:       http.Header{"Cache-Control": {"max-age=60"}, "Age": {"10"}},
+			requestTime:  responseTime.Add(-2 * time.Second),
+			wantLifetime: time.Minute,
+			wantAge:      12 * time.Second,
+		},
+		{
+			name:         "apparent age larger than Age",
+			header:       http.Header{"Date": {date}, "Age": {"1"}},
+			wantLifetime: 0,
+			wantAge:      5 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestTime := tt.requestTime
+			if requestTime.IsZero() {
+				requestTime = responseTime
+			}
+			entry := &cacheEntry{StatusCode: http.StatusOK, Header: tt.header, RequestTime: requestTime, ResponseTime: responseTime}
+			if got := entry.freshnessLifetime(); got != tt.wantLifetime {
+				t.Errorf("freshness lifetime = %v, want %v", got, tt.wantLifetime)
+			}
+			// the age grows with the time spent in the cache
+			if got := entry.age(responseTime.Add(time.Second)); got != tt.wantAge+time.Second {
+				t.Errorf("age = %v, want %v", got, tt.wantAge+time.Second)
+			}
+		})
+	}
+}
+
+func TestCacheStoresBodyClosedEarly(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "application/json")
+		// the decoder returns once it got the value, before the trailing newline and the end of the body
+		_, _ = io.WriteString(w, `{"id":1}`)
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		_, _ = io.WriteString(w, "\n")
+	}))
+	defer srv.Close()
+	client := newCacheClient(NewLRUCacheStore(1 << 20))
+
+	for range 2 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v struct{ ID int }
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil || v.ID != 1 {
+			t.Fatalf("decoded %+v, %v", v, err)
+		}
+		resp.Body.Close()
+	}
+	if calls.Load() != 1 {
+		t.Errorf("origin got %d requests, want the second one served from the cache", calls.Load())
+	}
+}
+
+func TestCacheSkipsLargeBody(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.(http.Flusher).Flush()
+		_, _ = io.WriteString(w, strings.Repeat("x", 100))
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: NewCacheTransport(WithMaxCacheEntryBytes(10))}
+
+	for range 2 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readBody(t, resp); len(body) != 100 {
+			t.Errorf("body has %d bytes, want 100", len(body))
+		}
+	}
+	if calls.Load() != 2 {
+		t.Errorf("origin got %d requests, want 2 as the body is larger than the maximum entry", calls.Load())
+	}
+}
+
+func TestLRUCacheStore(t *testing.T) {
+	store := NewLRUCacheStore(10)
+	store.Set("a", []byte("aaaa"))
+	store.Set("b", []byte("bbbb"))
+	// a becomes the most recently used, b is evicted to make room for c
+	if _, ok := store.Get("a"); !ok {
+		t.Fatal("a is missing")
+	}
+	store.Set("c", []byte("cccc"))
+	if _, ok := store.Get("b"); ok {
+		t.Error("b is kept, want the least recently used entry evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := store.Get(key); !ok {
+			t.Errorf("%s is evicted", key)
+		}
+	}
+
+	// replacing an entry frees its previous size
+	store.Set("a", []byte("a"))
+	store.Set("d", []byte("dddd"))
+	if len(store.entries) != 3 || store.size != 9 {
+		t.Errorf("store has %d entries of %d bytes, want 3 of 9", len(store.entries), store.size)
+	}
+
+	store.Set("e", []byte("too large for the store"))
+	if _, ok := store.Get("e"); ok {
+		t.Error("an entry larger than the store is kept")
+	}
+	store.Delete("c")
+	if _, ok := store.Get("c"); ok || store.size != 5 {
+		t.Errorf("c is kept after Delete, size %d", store.size)
+	}
+}
+
+func TestDiskCacheStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskCacheStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set("https://example.test/a", []byte("first"))
+	store.Set("https://example.test/a", []byte("second"))
+	store.Set("https://example.test/b", []byte("other"))
+
+	// a new store on the same directory sees the entries
+	reopened, err := NewDiskCacheStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reopened.Get("https://example.test/a"); !ok || string(got) != "second" {
+		t.Errorf("entry = %q %v, want the last one written", got, ok)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("directory has %d files, want one per entry", len(files))
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".tmp-") {
+			t.Errorf("temporary file %s is left behind", f.Name())
+		}
+	}
+
+	reopened.Delete("https://example.test/a")
+	if _, ok := store.Get("https://example.test/a"); ok {
+		t.Error("entry is kept after Delete")
+	}
+	if _, ok := store.Get("https://example.test/missing"); ok {
+		t.Error("missing entry is found")
+	}
+
+	// the transport works the same with the disk store
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "stored on disk")
+	}))
+	defer srv.Close()
+	client := newCacheClient(store)
+	for i, want := range []string{CacheStatusMiss, CacheStatusHit} {
+		if _, body, status := cacheDo(t, client, srv.URL, cacheStep{}); status != want || body != "stored on disk" {
+			t.Errorf("request %d = %s %q, want %s", i+1, status, body, want)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("origin got %d requests, want 1", calls.Load())
+	}
+}
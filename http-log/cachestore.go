@@ -0,0 +1,129 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CacheStore keeps the entries of CacheTransport, the key is the URL of the request.
+// It must be safe for concurrent use.
+type CacheStore interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, entry []byte)
+	Delete(key string)
+}
+
+// LRUCacheStore keeps the entries in memory, evicting the least recently used ones over its size
+type LRUCacheStore struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // the most recently used first
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value []byte
+}
+
+// NewLRUCacheStore creates a store keeping up to maxBytes of entries
+func NewLRUCacheStore(maxBytes int64) *LRUCacheStore {
+	return &LRUCacheStore{maxBytes: maxBytes, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (s *LRUCacheStore) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+func (s *LRUCacheStore) Set(key string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+	if int64(len(value)) > s.maxBytes {
+		return
+	}
+	s.entries[key] = s.order.PushFront(&lruEntry{key: key, value: value})
+	s.size += int64(len(value))
+	for s.size > s.maxBytes {
+		s.remove(s.order.Back().Value.(*lruEntry).key)
+	}
+}
+
+func (s *LRUCacheStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+}
+
+// remove deletes the entry, it must be called with the lock held
+func (s *LRUCacheStore) remove(key string) {
+	e, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	s.order.Remove(e)
+	delete(s.entries, key)
+	s.size -= int64(len(e.Value.(*lruEntry).value))
+}
+
+// DiskCacheStore keeps every entry in a file of the directory, named after the hash of the key.
+// Entries are written to a temporary file first, so a reader never sees a partial entry.
+type DiskCacheStore struct {
+	dir string
+}
+
+// NewDiskCacheStore creates a store in dir, creating the directory when it doesn't exist
+func NewDiskCacheStore(dir string) (*DiskCacheStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &DiskCacheStore{dir: dir}, nil
+}
+
+func (s *DiskCacheStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *DiskCacheStore) Get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// Set writes the entry, a failed write leaves the previous entry in place
+func (s *DiskCacheStore) Set(key string, value []byte) {
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(value)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(key))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+}
+
+func (s *DiskCacheStore) Delete(key string) {
+	_ = os.Remove(s.path(key))
+}
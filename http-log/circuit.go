@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without sending the request while the circuit of the host is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitState is the state of the circuit of a single host
+type CircuitState int
+
+const (
+	// CircuitClosed lets every request through and counts the failures
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails every request with ErrCircuitOpen until the open timeout passes
+	CircuitOpen
+	// CircuitHalfOpen lets a few probe requests through, they decide whether the circuit closes or opens again
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// CircuitStatus describes the circuit of a host, see CircuitBreakerTransport.States
+type CircuitStatus struct {
+	State    CircuitState `json:"state"`
+	Since    time.Time    `json:"since"`
+	Requests int          `json:"requests"` // in the rolling window
+	Failures int          `json:"failures"` // in the rolling window
+}
+
+// CircuitBreakerTransport stops sending requests to a host which keeps failing.
+// Failures are counted per host in a rolling window, once their ratio reaches the threshold the circuit opens
+// and requests fail fast with ErrCircuitOpen. After the open timeout a few probe requests are let through,
+// if they succeed the circuit closes, otherwise it opens again. Every state transition is logged.
+type CircuitBreakerTransport struct {
+	rt               http.RoundTripper
+	logger           *slog.Logger
+	window           time.Duration
+	failureRatio     float64
+	minRequests      int
+	openTimeout      time.Duration
+	halfOpenRequests int
+	isFailure        func(resp *http.Response, err error) bool
+
+	mu    sync.Mutex
+	hosts map[string]*circuit
+}
+
+func NewCircuitBreakerTransport(options ...CircuitBreakerOption) *CircuitBreakerTransport {
+	t := &CircuitBreakerTransport{
+		rt:               http.DefaultTransport,
+		logger:           slog.Default(),
+		window:           time.Minute,
+		failureRatio:     0.5,
+		minRequests:      10,
+		openTimeout:      30 * time.Second,
+		halfOpenRequests: 1,
+		isFailure:        DefaultFailurePredicate,
+		hosts:            make(map[string]*circuit),
+	}
+
+	for _, option := range options {
+		option(t)
+	}
+
+	return t
+}
+
+type CircuitBreakerOption func(transport *CircuitBreakerTransport)
+
+func WithBreakerRoundTripper(rt http.RoundTripper) CircuitBreakerOption {
+	return func(t *CircuitBreakerTransport) {
+		t.rt = rt
+	}
+}
+
+func WithBreakerLogger(logger *slog.Logger) CircuitBreakerOption {
+	return func(t *CircuitBreakerTransport) {
+		t.logger = logger
+	}
+}
+
+// WithFailureThreshold opens the circuit when at least ratio of the requests in the rolling window failed.
+// The circuit doesn't open before the window holds minRequests requests.
+func WithFailureThreshold(ratio float64, minRequests int) CircuitBreakerOption {
+	return func(t *CircuitBreakerTransport) {
+		t.failureRatio = ratio
+		t.minRequests = minRequests
+	}
+}
+
+// WithRollingWindow sets how long the outcome of a request is counted
+func WithRollingWindow(window time.Duration) CircuitBreakerOption {
+	return func(t *CircuitBreakerTransport) {
+		t.window = window
+	}
+}
+
+// WithOpenTimeout sets how long the circuit stays open before the probe requests are let through
+func WithOpenTimeout(timeout time.Duration) CircuitBreakerOption {
+	return func(t *CircuitBreakerTransport) {
+		t.openTimeout = timeout
+	}
+}
+
+// WithHalfOpenRequests sets how many probe requests have to succeed to close the circuit
+func WithHalfOpenRequests(requests int) CircuitBreakerOption {
+	return func(t *CircuitBreakerTransport) {
+		t.halfOpenRequests = requests
+	}
+}
+
+// WithFailurePredicate replaces DefaultFailurePredicate
+func WithFailurePredicate(isFailure func(resp *http.Response, err error) bool) CircuitBreakerOption {
+	return func(t *CircuitBreakerTransport) {
+		t.isFailure = isFailure
+	}
+}
+
+// DefaultFailurePredicate counts transport errors and 5xx responses as failures.
+// Requests canceled by the caller are not failures of the host.
+func DefaultFailurePredicate(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+// circuitBuckets is the number of buckets the rolling window is split into
+const circuitBuckets = 10
+
+// circuit is the state of a single host
+type circuit struct {
+	state     CircuitState
+	since     time.Time
+	buckets   [circuitBuckets]circuitBucket
+	probes    int // probe requests in flight
+	succeeded int // successful probe requests
+}
+
+type circuitBucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+// circuitTransition is logged once the lock is released
+type circuitTransition struct {
+	host     string
+	from, to CircuitState
+	requests int
+	failures int
+}
+
+func (t *CircuitBreakerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rCtx := r.Context()
+	host := r.URL.Host
+
+	probe, transition, err := t.allow(host)
+	t.logTransition(rCtx, transition)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.rt.RoundTrip(r)
+
+	// a request canceled by the caller says nothing about the host, it's neither a success nor a failure
+	if errors.Is(rCtx.Err(), context.Canceled) {
+		t.release(host, probe)
+		return resp, err
+	}
+	transition = t.record(host, probe, t.isFailure(resp, err))
+	t.logTransition(rCtx, transition)
+
+	return resp, err
+}
+
+// States returns the state of the circuit of every host the transport has seen
+func (t *CircuitBreakerTransport) States() map[string]CircuitStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	states := make(map[string]CircuitStatus, len(t.hosts))
+	for host, c := range t.hosts {
+		requests, failures := c.counts(now, t.window)
+		states[host] = CircuitStatus{State: c.state, Since: c.since, Requests: requests, Failures: failures}
+	}
+	return states
+}
+
+// allow decides whether the request is sent, probe is set for the requests sent while the circuit is half-open
+func (t *CircuitBreakerTransport) allow(host string) (bool, *circuitTransition, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.hosts[host]
+	if !ok {
+		c = &circuit{state: CircuitClosed, since: time.Now()}
+		t.hosts[host] = c
+	}
+
+	var transition *circuitTransition
+	if c.state == CircuitOpen && time.Since(c.since) >= t.openTimeout {
+		transition = t.transition(host, c, CircuitHalfOpen)
+	}
+
+	switch c.state {
+	case CircuitOpen:
+		return false, transition, fmt.Errorf("%w: %s", ErrCircuitOpen, host)
+	case CircuitHalfOpen:
+		if c.probes+c.succeeded >= t.halfOpenRequests {
+			return false, transition, fmt.Errorf("%w: %s", ErrCircuitOpen, host)
+		}
+		c.probes++
+		return true, transition, nil
+	}
+	return false, transition, nil
+}
+
+// record counts the outcome of the request and moves the circuit to the next state
+func (t *CircuitBreakerTransport) record(host string, probe, failed bool) *circuitTransition {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.hosts[host]
+	now := time.Now()
+
+	switch c.state {
+	case CircuitClosed:
+		c.add(now, t.window, failed)
+		requests, failures := c.counts(now, t.window)
+		if requests >= t.minRequests && float64(failures) >= t.failureRatio*float64(requests) {
+			return t.transition(host, c, CircuitOpen)
+		}
+	case CircuitHalfOpen:
+		// requests sent before the circuit opened don't decide about it
+		if !probe {
+			return nil
+		}
+		c.probes--
+		if failed {
+			return t.transition(host, c, CircuitOpen)
+		}
+		c.succeeded++
+		if c.succeeded >= t.halfOpenRequests {
+			return t.transition(host, c, CircuitClosed)
+		}
+	}
+	return nil
+}
+
+// release frees the slot of a probe request without counting its outcome
+func (t *CircuitBreakerTransport) release(host string, probe bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c := t.hosts[host]; probe && c.state == CircuitHalfOpen {
+		c.probes--
+	}
+}
+
+// transition changes the state of the circuit, it must be called with the lock held
+func (t *CircuitBreakerTransport) transition(host string, c *circuit, to CircuitState) *circuitTransition {
+	requests, failures := c.counts(time.Now(), t.window)
+	transition := &circuitTransition{host: host, from: c.state, to: to, requests: requests, failures: failures}
+
+	c.state = to
+	c.since = time.Now()
+	c.probes = 0
+	c.succeeded = 0
+	if to == CircuitClosed {
+		c.buckets = [circuitBuckets]circuitBucket{}
+	}
+	return transition
+}
+
+func (t *CircuitBreakerTransport) logTransition(ctx context.Context, transition *circuitTransition) {
+	if transition == nil {
+		return
+	}
+	level := slog.LevelInfo
+	if transition.to == CircuitOpen {
+		level = slog.LevelWarn
+	}
+	t.logger.LogAttrs(ctx, level, "circuit breaker state changed",
+		slog.String("host", transition.host),
+		slog.String("from", transition.from.String()),
+		slog.String("to", transition.to.String()),
+		slog.Int("requests", transition.requests),
+		slog.Int("failures", transition.failures),
+	)
+}
+
+// add counts the request in the bucket of the current time, a bucket older than the window is reset
+func (c *circuit) add(now time.Time, window time.Duration, failed bool) {
+	width := window / circuitBuckets
+	if width <= 0 {
+		width = 1
+	}
+	// the start and the index are both counted from the Unix epoch, Truncate counts from the zero time
+	index := now.UnixNano() / int64(width)
+	start := time.Unix(0, index*int64(width))
+	b := &c.buckets[index%circuitBuckets]
+	if !b.start.Equal(start) {
+		*b = circuitBucket{start: start}
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+}
+
+// counts sums the buckets within the window
+func (c *circuit) counts(now time.Time, window time.Duration) (int, int) {
+	var requests, failures int
+	for _, b := range c.buckets {
+		if now.Sub(b.start) < window {
+			requests += b.requests
+			failures += b.failures
+		}
+	}
+	return requests, failures
+}
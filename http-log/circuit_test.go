@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testOpenTimeout = 50 * time.Millisecond
+
+// newTestBreaker returns a breaker opening after 2 requests of which half failed, whose transitions are logged
+// into the returned buffer
+func newTestBreaker(t *testing.T, options ...CircuitBreakerOption) (*CircuitBreakerTransport, *syncBuffer) {
+	t.Helper()
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	breaker := NewCircuitBreakerTransport(append([]CircuitBreakerOption{
+		WithBreakerLogger(logger),
+		WithFailureThreshold(0.5, 2),
+		WithOpenTimeout(testOpenTimeout),
+		WithBreakerRoundTripper(http.DefaultTransport.(*http.Transport).Clone()),
+	}, options...)...)
+	return breaker, &logs
+}
+
+// toggleServer answers 500 while failing is set and 200 otherwise
+func toggleServer(t *testing.T, failing *atomic.Bool, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func breakerGet(ctx context.Context, client *http.Client, url string) error {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	var failing atomic.Bool
+	var calls atomic.Int32
+	srv := toggleServer(t, &failing, &calls)
+	breaker, logs := newTestBreaker(t)
+	client := &http.Client{Transport: breaker}
+	host := strings.TrimPrefix(srv.URL, "http://")
+	state := func() CircuitState { return breaker.States()[host].State }
+
+	// closed: a success and a failure reach the threshold
+	if err := breakerGet(t.Context(), client, srv.URL); err != nil || state() != CircuitClosed {
+		t.Fatalf("first request: %v, state %s, want closed", err, state())
+	}
+	failing.Store(true)
+	if err := breakerGet(t.Context(), client, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if state() != CircuitOpen {
+		t.Fatalf("state = %s after 1 failure in 2 requests, want open", state())
+	}
+
+	// open: the request fails without reaching the server
+	if err := breakerGet(t.Context(), client, srv.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("request while open: %v, want ErrCircuitOpen", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("server got %d requests, want 2", calls.Load())
+	}
+
+	// half-open: a failed probe opens the circuit again
+	time.Sleep(testOpenTimeout)
+	if err := breakerGet(t.Context(), client, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if state() != CircuitOpen {
+		t.Fatalf("state = %s after a failed probe, want open", state())
+	}
+
+	// half-open: a successful probe closes it
+	failing.Store(false)
+	time.Sleep(testOpenTimeout)
+	if err := breakerGet(t.Context(), client, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if status := breaker.States()[host]; status.State != CircuitClosed || status.Requests != 0 {
+		t.Fatalf("status = %+v after a successful probe, want closed with an empty window", status)
+	}
+	if calls.Load() != 4 {
+		t.Errorf("server got %d requests, want 4", calls.Load())
+	}
+
+	var transitions []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if strings.Contains(line, "circuit breaker state changed") {
+			from, _, _ := strings.Cut(line[strings.Index(line, "from=")+len("from="):], " ")
+			to, _, _ := strings.Cut(line[strings.Index(line, "to=")+len("to="):], " ")
+			transitions = append(transitions, from+">"+to)
+		}
+	}
+	want := []string{"closed>open", "open>half-open", "half-open>open", "open>half-open", "half-open>closed"}
+	if strings.Join(transitions, " ") != strings.Join(want, " ") {
+		t.Errorf("transitions = %v, want %v", transitions, want)
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbes(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		<-release
+	}))
+	defer srv.Close()
+	breaker, _ := newTestBreaker(t, WithFailureThreshold(1, 1))
+	client := &http.Client{Transport: breaker}
+
+	if err := breakerGet(t.Context(), client, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(testOpenTimeout)
+
+	// the probe hangs, the other requests fail fast while it is in flight
+	probeDone := make(chan error, 1)
+	go func() { probeDone <- breakerGet(t.Context(), client, srv.URL) }()
+	for calls.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := breakerGet(t.Context(), client, srv.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("request during the probe: %v, want ErrCircuitOpen", err)
+	}
+	close(release)
+	if err := <-probeDone; err != nil {
+		t.Fatal(err)
+	}
+	for host, status := range breaker.States() {
+		if status.State != CircuitClosed {
+			t.Errorf("%s is %s after the probe succeeded, want closed", host, status.State)
+		}
+	}
+}
+
+func TestCircuitBreakerReleasesCanceledProbe(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		case 2:
+			// the probe is canceled by the caller while it waits
+			<-r.Context().Done()
+		}
+	}))
+	defer srv.Close()
+	breaker, _ := newTestBreaker(t, WithFailureThreshold(1, 1))
+	client := &http.Client{Transport: breaker}
+
+	if err := breakerGet(t.Context(), client, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(testOpenTimeout)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	go func() {
+		for calls.Load() < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	if err := breakerGet(ctx, client, srv.URL); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled probe: %v, want context.Canceled", err)
+	}
+	for host, status := range breaker.States() {
+		if status.State != CircuitHalfOpen {
+			t.Errorf("%s is %s after the canceled probe, want still half-open", host, status.State)
+		}
+	}
+
+	// the slot of the canceled probe is free for the next one
+	if err := breakerGet(t.Context(), client, srv.URL); err != nil {
+		t.Fatalf("probe after the canceled one: %v", err)
+	}
+	for host, status := range breaker.States() {
+		if status.State != CircuitClosed {
+			t.Errorf("%s is %s, want closed", host, status.State)
+		}
+	}
+}
+
+func TestCircuitOpenLogLevel(t *testing.T) {
+	var failing atomic.Bool
+	var calls atomic.Int32
+	failing.Store(true)
+	srv := toggleServer(t, &failing, &calls)
+	breaker, _ := newTestBreaker(t, WithFailureThreshold(1, 1))
+
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	client := &http.Client{Transport: NewLoggingTransport(WithLogger(logger), WithRoundTripper(breaker))}
+	for range 2 {
+		_ = breakerGet(t.Context(), client, srv.URL)
+	}
+
+	var rejected string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "error.type=") {
+			rejected = line
+		}
+	}
+	if !strings.Contains(rejected, "level=DEBUG") || !strings.Contains(rejected, "error.type="+ErrorTypeCircuitOpen) {
+		t.Errorf("fail-fast request is logged as\n%s\nwant Debug with error.type=%s", rejected, ErrorTypeCircuitOpen)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// headerFlags collects the repeated -H flags
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("header %q is not in the Name: value form", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// cliOptions are the flags of the command line tool
+type cliOptions struct {
+	method    string
+	url       string
+	headers   headerFlags
+	data      string
+	repeat    int
+	json      bool
+	reproduce ReproduceFormat
+	output    string
+	color     bool
+}
+
+type requestInfoCaptureKey struct{}
+
+// requestInfoCapture receives the requestInfo of the exchange sent with its context, see withRequestInfoCapture
+type requestInfoCapture struct {
+	reqInfo *requestInfo
+}
+
+// withRequestInfoCapture lets the caller of LoggingTransport read the timing of the exchange
+func withRequestInfoCapture(ctx context.Context) (context.Context, *requestInfoCapture) {
+	capture := &requestInfoCapture{}
+	return context.WithValue(ctx, requestInfoCaptureKey{}, capture), capture
+}
+
+func captureRequestInfo(ctx context.Context, reqInfo *requestInfo) {
+	if capture, ok := ctx.Value(requestInfoCaptureKey{}).(*requestInfoCapture); ok {
+		capture.reqInfo = reqInfo
+	}
+}
+
+// readData returns the request body given with -d, @file reads it from the file and @- from stdin
+func readData(data string) ([]byte, error) {
+	switch {
+	case data == "":
+		return nil, nil
+	case data == "@-":
+		return io.ReadAll(os.Stdin)
+	case strings.HasPrefix(data, "@"):
+		return os.ReadFile(data[1:])
+	}
+	return []byte(data), nil
+}
+
+// runCLI sends the request opts.repeat times with the client and prints the waterfall of every exchange
+func runCLI(ctx context.Context, client *http.Client, opts cliOptions, stdout io.Writer) error {
+	body, err := readData(opts.data)
+	if err != nil {
+		return fmt.Errorf("reading the request body: %w", err)
+	}
+
+	var results []cliResult
+	var failed error
+	for i := 0; i < opts.repeat; i++ {
+		result, reqInfo, err := sendCLIRequest(ctx, client, opts, body)
+		if err != nil && reqInfo == nil {
+			return err
+		}
+		if opts.reproduce != "" && i == 0 {
+			reproduction, err := reqInfo.reproduce(opts.reproduce)
+			if err != nil {
+				return err
+			}
+			// stdout must stay a single JSON document
+			if opts.json {
+				result.Reproduction = reproduction
+			} else {
+				fmt.Fprintln(stdout, reproduction)
+				fmt.Fprintln(stdout)
+			}
+		}
+		if err != nil {
+			failed = err
+		}
+		if opts.json {
+			results = append(results, result)
+			continue
+		}
+		printCLIResult(stdout, opts, i, result, reqInfo)
+	}
+
+	if opts.json {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	}
+	return failed
+}
+
+func sendCLIRequest(ctx context.Context, client *http.Client, opts cliOptions, body []byte) (cliResult, *requestInfo, error) {
+	ctx, capture := withRequestInfoCapture(ctx)
+	req, err := http.NewRequestWithContext(ctx, opts.method, opts.url, bytes.NewReader(body))
+	if err != nil {
+		return cliResult{}, nil, err
+	}
+	for _, header := range opts.headers {
+		name, value, _ := strings.Cut(header, ":")
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	resp, err := client.Do(req)
+	if err == nil {
+		err = writeCLIBody(resp.Body, opts.output)
+	}
+	reqInfo := capture.reqInfo
+	if reqInfo == nil {
+		return cliResult{}, nil, err
+	}
+	return newCLIResult(reqInfo), reqInfo, err
+}
+
+// writeCLIBody reads the whole response body, so the connection can be reused, and writes it to -o
+func writeCLIBody(body io.ReadCloser, output string) error {
+	defer body.Close()
+	w := io.Discard
+	switch output {
+	case "":
+	case "-":
+		w = os.Stdout
+	default:
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err := io.Copy(w, body)
+	return err
+}
+
+// waterfallPhase is a phase of the exchange, start is the offset since the start of the request
+type waterfallPhase struct {
+	Name     string        `json:"name"`
+	Start    time.Duration `json:"-"`
+	Duration time.Duration `json:"-"`
+	StartMs  float64       `json:"start_ms"`
+	Ms       float64       `json:"duration_ms"`
+}
+
+// waterfallPhases lays the measured phases out one after another, server processing ends with the response headers
+// and the transfer with the last byte of the body
+func waterfallPhases(reqInfo *requestInfo) ([]waterfallPhase, time.Duration) {
+	reqInfo.muTrace.Lock()
+	defer reqInfo.muTrace.Unlock()
+
+	var phases []waterfallPhase
+	at := time.Duration(0)
+	add := func(name string, start, d time.Duration) {
+		if d > 0 {
+			phases = append(phases, waterfallPhase{Name: name, Start: start, Duration: d, StartMs: harMillis(start), Ms: harMillis(d)})
+		}
+	}
+	next := func(name string, d time.Duration) {
+		add(name, at, d)
+		at += d
+	}
+
+	next("queue", reqInfo.QueueWait)
+	if reqInfo.ConnectionReused {
+		next("connection", reqInfo.GetConnection)
+	} else {
+		next("dns", reqInfo.DNSLookup)
+		next("dial", reqInfo.Dialing)
+		next("tls", reqInfo.TLSHandshake)
+	}
+	if reqInfo.ResponseErr != nil {
+		return phases, reqInfo.Duration
+	}
+	add("server", max(reqInfo.Duration-reqInfo.ServerProcessing, at), reqInfo.ServerProcessing)
+	total := reqInfo.Duration
+	if reqInfo.TimeToLastByte > reqInfo.Duration {
+		add("transfer", reqInfo.Duration, reqInfo.TimeToLastByte-reqInfo.Duration)
+		total = reqInfo.TimeToLastByte
+	}
+	return phases, total
+}
+
+// cliResult is the JSON output of a single exchange
+type cliResult struct {
+	URL              string           `json:"url"`
+	Status           string           `json:"status,omitempty"`
+	Proto            string           `json:"proto,omitempty"`
+	ConnectionReused bool             `json:"connection_reused"`
+	Bytes            int64            `json:"bytes"`
+	Error            string           `json:"error,omitempty"`
+	ErrorType        string           `json:"error_type,omitempty"`
+	Phases           []waterfallPhase `json:"phases"`
+	TotalMs          float64          `json:"total_ms"`
+	// Reproduction is the request in the format of -reproduce, only the first exchange has it
+	Reproduction string `json:"reproduction,omitempty"`
+}
+
+func newCLIResult(reqInfo *requestInfo) cliResult {
+	phases, total := waterfallPhases(reqInfo)
+	if phases == nil {
+		phases = []waterfallPhase{}
+	}
+	result := cliResult{
+		URL:              reqInfo.redactedURL(),
+		Status:           reqInfo.ResponseStatus,
+		Proto:            reqInfo.ResponseProto,
+		ConnectionReused: reqInfo.ConnectionReused,
+		Bytes:            reqInfo.BytesRead,
+		ErrorType:        reqInfo.ErrorType,
+		Phases:           phases,
+		TotalMs:          harMillis(total),
+	}
+	if reqInfo.ResponseErr != nil {
+		result.Error = reqInfo.ResponseErr.Error()
+	}
+	return result
+}
+
+var phaseLabels = map[string]string{
+	"queue":      "Queue Wait",
+	"connection": "Connection Reuse",
+	"dns":        "DNS Lookup",
+	"dial":       "TCP Connection",
+	"tls":        "TLS Handshake",
+	"server":     "Server Processing",
+	"transfer":   "Content Transfer",
+}
+
+var phaseColors = map[string]string{
+	"queue":      "\x1b[90m",
+	"connection": "\x1b[37m",
+	"dns":        "\x1b[36m",
+	"dial":       "\x1b[33m",
+	"tls":        "\x1b[35m",
+	"server":     "\x1b[32m",
+	"transfer":   "\x1b[34m",
+}
+
+const (
+	colorReset    = "\x1b[0m"
+	waterfallBars = 50
+)
+
+func printCLIResult(w io.Writer, opts cliOptions, i int, result cliResult, reqInfo *requestInfo) {
+	paint := func(color, s string) string {
+		if !opts.color {
+			return s
+		}
+		return color + s + colorReset
+	}
+
+	if opts.repeat > 1 {
+		fmt.Fprintf(w, "#%d ", i+1)
+	}
+	if result.Error != "" {
+		fmt.Fprintf(w, "%s %s\n", paint("\x1b[31m", result.ErrorType), result.Error)
+	} else {
+		fmt.Fprintf(w, "%s %s\n", result.Proto, paint("\x1b[1m", result.Status))
+		if i == 0 {
+			names := make([]string, 0, len(reqInfo.ResponseHeaders))
+			for name := range reqInfo.ResponseHeaders {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(w, "%s: %s\n", paint("\x1b[90m", name), strings.Join(reqInfo.ResponseHeaders[name], ", "))
+			}
+		}
+	}
+	fmt.Fprintln(w)
+
+	phases, total := waterfallPhases(reqInfo)
+	scale := float64(waterfallBars) / float64(max(total, 1))
+	for _, phase := range phases {
+		offset := int(float64(phase.Start) * scale)
+		width := max(int(float64(phase.Duration)*scale), 1)
+		width = min(width, waterfallBars-min(offset, waterfallBars-1))
+		bar := strings.Repeat(" ", min(offset, waterfallBars-1)) + paint(phaseColors[phase.Name], strings.Repeat("█", width))
+		fmt.Fprintf(w, "  %-18s %9.2fms  |%s\n", phaseLabels[phase.Name], phase.Ms, bar)
+	}
+	fmt.Fprintf(w, "  %-18s %9.2fms\n", "Total", harMillis(total))
+	if result.ConnectionReused {
+		fmt.Fprintln(w, "  (connection reused)")
+	}
+	fmt.Fprintln(w)
+}
+
+// colorEnabled reports whether the output is a terminal which wants colors, see https://no-color.org
+func colorEnabled(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCLIJSONReproduction(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: NewLoggingTransport(WithLogger(discardLogger()), WithBodyLogging(1<<20))}
+	opts := cliOptions{method: http.MethodPost, url: srv.URL, data: "a=1", repeat: 2, json: true, reproduce: FormatCurl}
+
+	var stdout bytes.Buffer
+	if err := runCLI(t.Context(), client, opts, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	var results []cliResult
+	if err := json.Unmarshal(stdout.Bytes(), &results); err != nil {
+		t.Fatalf("stdout is not a JSON document: %v\n%s", err, stdout.String())
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if !strings.HasPrefix(results[0].Reproduction, "curl -X POST") || !strings.Contains(results[0].Reproduction, "a=1") {
+		t.Errorf("reproduction = %q, want the curl command of the request", results[0].Reproduction)
+	}
+	if results[1].Reproduction != "" {
+		t.Errorf("second result has the reproduction %q, want it only once", results[1].Reproduction)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+type ctxKey string
+
+const slogFields ctxKey = "slog_fields"
+
+// AppendCtx returns a copy of context.Context with value named slogFields containing []slog.Attr needed for ContextHandler.
+// It's the AppendCtx of slog-access-log, so a server middleware can attach e.g. correlation_id to the context
+// and LoggingTransport carries it to the next service, see WithContextHeader.
+func AppendCtx(parent context.Context, attr slog.Attr) context.Context {
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	v, _ := parent.Value(slogFields).([]slog.Attr)
+	// the attributes of the parent must not be modified by a sibling context
+	return context.WithValue(parent, slogFields, append(slices.Clip(v), attr))
+}
+
+// attrsFromContext returns the attributes added with AppendCtx
+func attrsFromContext(ctx context.Context) []slog.Attr {
+	attrs, _ := ctx.Value(slogFields).([]slog.Attr)
+	return attrs
+}
+
+// ContextHandler is used to log fields added to context.Context
+type ContextHandler struct {
+	slog.Handler
+}
+
+func (h ContextHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.AddAttrs(attrsFromContext(ctx)...)
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return ContextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h ContextHandler) WithGroup(name string) slog.Handler {
+	return ContextHandler{h.Handler.WithGroup(name)}
+}
+
+// contextHeader copies the context attribute key into the request header
+type contextHeader struct {
+	key    string
+	header string
+}
+
+// WithContextHeader sets the header of outgoing requests to the value of the context attribute key added with AppendCtx,
+// e.g. WithContextHeader("correlation_id", "X-Correlation-ID"), so the ID follows the request to the next service.
+// A header already set on the request is kept.
+func WithContextHeader(key, header string) Option {
+	return func(t *LoggingTransport) {
+		// the slice may be shared with the transport WithOptions overrides
+		t.contextHeaders = append(slices.Clip(t.contextHeaders), contextHeader{key: key, header: header})
+	}
+}
+
+// withContextHeaders returns a copy of the request carrying the headers of WithContextHeader
+func (t *LoggingTransport) withContextHeaders(r *http.Request) *http.Request {
+	attrs := attrsFromContext(r.Context())
+	if len(t.contextHeaders) == 0 || len(attrs) == 0 {
+		return r
+	}
+
+	cloned := false
+	for _, ch := range t.contextHeaders {
+		if r.Header.Get(ch.header) != "" {
+			continue
+		}
+		// the last attribute with the key wins, like a nested context
+		for i := len(attrs) - 1; i >= 0; i-- {
+			if attrs[i].Key != ch.key {
+				continue
+			}
+			// the headers of the caller's request must not be modified
+			if !cloned {
+				r = r.Clone(r.Context())
+				cloned = true
+			}
+			r.Header.Set(ch.header, attrs[i].Value.Resolve().String())
+			break
+		}
+	}
+	return r
+}
+
+// contextAttrs returns the attributes added with AppendCtx which the records of the exchange carry.
+// They are left to the handler when it's a ContextHandler, which adds them itself.
+func (t *LoggingTransport) contextAttrs(ctx context.Context) []slog.Attr {
+	switch t.logger.Handler().(type) {
+	case ContextHandler, *ContextHandler:
+		return nil
+	}
+	return attrsFromContext(ctx)
+}
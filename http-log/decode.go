@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// contentEncodings parses a Content-Encoding header, it returns nil when the body is not encoded
+func contentEncodings(contentEncoding string) []string {
+	var encodings []string
+	for _, encoding := range strings.Split(contentEncoding, ",") {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		if encoding != "" && encoding != "identity" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	return encodings
+}
+
+// decoder returns a reader decompressing r, the closer releases the resources of the decoder
+func decoder(encoding string, r io.Reader) (io.Reader, func(), error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, func() { zr.Close() }, nil
+	case "deflate":
+		// deflate is zlib framed, but some servers send the raw deflate stream
+		br := bufio.NewReader(r)
+		if header, err := br.Peek(2); err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, nil, err
+			}
+			return zr, func() { zr.Close() }, nil
+		}
+		fr := flate.NewReader(br)
+		return fr, func() { fr.Close() }, nil
+	case "br":
+		return brotli.NewReader(r), func() {}, nil
+	case "zstd":
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// decodeBody decompresses the captured bytes of a body with the given content codings, up to max bytes.
+// When the capture was truncated the stream ends early and whatever could be decoded until then is returned.
+// The returned flag reports whether the decoded body is incomplete.
+func decodeBody(encodings []string, raw []byte, rawTruncated bool, max int64) ([]byte, bool, error) {
+	var r io.Reader = bytes.NewReader(raw)
+	// the codings are listed in the order they were applied
+	for i := len(encodings) - 1; i >= 0; i-- {
+		dr, closeDecoder, err := decoder(encodings[i], r)
+		if err != nil {
+			if rawTruncated && errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, true, nil
+			}
+			return nil, rawTruncated, err
+		}
+		defer closeDecoder()
+		r = dr
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil && !rawTruncated {
+		return nil, false, err
+	}
+	if int64(len(decoded)) > max {
+		return decoded[:max], true, nil
+	}
+	return decoded, rawTruncated, nil
+}
+
+// decodeForLog decodes a captured body sent with the given Content-Encoding so it's readable in the log.
+// The attributes report the encoding, the compressed size of the whole body when it's known
+// and the decompressed size of the captured part, which is the whole body unless it was truncated.
+// Bodies which are not encoded are returned as they are, without attributes.
+func decodeForLog(contentEncoding string, raw []byte, truncated bool, compressedBytes, max int64) ([]byte, bool, []slog.Attr) {
+	encodings := contentEncodings(contentEncoding)
+	if encodings == nil {
+		return raw, truncated, nil
+	}
+
+	attrs := []slog.Attr{slog.String("encoding", strings.Join(encodings, ", "))}
+	if compressedBytes >= 0 {
+		attrs = append(attrs, slog.Int64("compressed_bytes", compressedBytes))
+	}
+	body, truncated, err := decodeBody(encodings, raw, truncated, max)
+	if err != nil {
+		return nil, truncated, append(attrs, slog.String("decode_error", err.Error()))
+	}
+	return body, truncated, append(attrs, slog.Int("decompressed_bytes", len(body)))
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Schema selects the field names of the single exchange event
+type Schema int
+
+const (
+	// SchemaDefault uses the keys of the split records grouped into request, response, timing and tls
+	SchemaDefault Schema = iota
+	// SchemaOTel follows the OpenTelemetry HTTP and TLS semantic conventions, the headers are logged as
+	// http.request.header.<lowercase name> with an array of values.
+	// The conventions have no attributes for the bodies and their encoding, the timing phases, the connection reuse,
+	// the cache status or a body closed early, they are logged under the project-specific http_log namespace,
+	// e.g. http_log.timing.dns_lookup in seconds.
+	// See https://opentelemetry.io/docs/specs/semconv/http/http-spans/
+	SchemaOTel
+	// SchemaECS follows the Elastic Common Schema
+	// See https://www.elastic.co/guide/en/ecs/current/ecs-http.html
+	SchemaECS
+)
+
+// WithSingleEvent emits one "http exchange" record per exchange instead of the split records.
+// The record is emitted once the response body is read or closed, so it includes the whole transfer.
+func WithSingleEvent(schema Schema) Option {
+	return func(t *LoggingTransport) {
+		t.singleEvent = true
+		t.schema = schema
+	}
+}
+
+// eventField is a logical field of the exchange event, each schema maps it to a dotted key
+type eventField int
+
+const (
+	fieldMethod eventField = iota
+	fieldURL
+	fieldRequestHeaders
+	fieldRequestBody
+	fieldRequestBodyEncoding
+	fieldStatus
+	fieldStatusCode
+	fieldProtocol
+	fieldResponseHeaders
+	fieldResponseBody
+	fieldResponseBodyEncoding
+	fieldBytes
+	fieldClosedEarly
+	fieldError
+	fieldErrorType
+	fieldCacheStatus
+	fieldAttempt
+	fieldDuration
+	fieldQueueWait
+	fieldDNSLookup
+	fieldDial
+	fieldTLSHandshake
+	fieldGetConnection
+	fieldServerProcessing
+	fieldTimeToLastByte
+	fieldConnectionReused
+	fieldTLSVersion
+	fieldTLSCipher
+	fieldTLSALPN
+	fieldTLSSNI
+	fieldTLSResumed
+	fieldTLSSubject
+	fieldTLSIssuer
+	fieldTLSNotAfter
+)
+
+// schemaDef maps the logical fields to keys, a dot in the key nests the value in a group
+type schemaDef struct {
+	keys     map[eventField]string
+	duration func(d time.Duration) slog.Value
+	// headerArrays logs every header under its lowercase name with an array of values instead of joining them
+	headerArrays bool
+	// resendCount logs the number of times the request was sent before instead of the attempt number,
+	// the first attempt has none
+	resendCount bool
+}
+
+var schemas = map[Schema]schemaDef{
+	SchemaDefault: {
+		keys: map[eventField]string{
+			fieldMethod:               "request.method",
+			fieldURL:                  "request.url",
+			fieldRequestHeaders:       "request.headers",
+			fieldRequestBody:          "request.body",
+			fieldRequestBodyEncoding:  "request.body_encoding",
+			fieldAttempt:              "request.attempt",
+			fieldStatus:               "response.status",
+			fieldStatusCode:           "response.status_code",
+			fieldProtocol:             "response.proto",
+			fieldResponseHeaders:      "response.headers",
+			fieldResponseBody:         "response.body",
+			fieldResponseBodyEncoding: "response.body_encoding",
+			fieldBytes:                "response.bytes",
+			fieldClosedEarly:          "response.closed_early",
+			fieldError:                "error.message",
+			fieldErrorType:            "error.type",
+			fieldCacheStatus:          "response.cache_status",
+			fieldDuration:             "timing.Duration_ms",
+			fieldQueueWait:            "timing.QueueWait_ms",
+			fieldDNSLookup:            "timing.DNSLookup_ms",
+			fieldDial:                 "timing.Dial_ms",
+			fieldTLSHandshake:         "timing.TLSHandshake_ms",
+			fieldGetConnection:        "timing.GetConnection_ms",
+			fieldServerProcessing:     "timing.ServerProcessing_ms",
+			fieldTimeToLastByte:       "timing.TimeToLastByte_ms",
+			fieldConnectionReused:     "timing.ConnectionReused",
+			fieldTLSVersion:           "tls.version",
+			fieldTLSCipher:            "tls.cipher_suite",
+			fieldTLSALPN:              "tls.alpn",
+			fieldTLSSNI:               "tls.sni",
+			fieldTLSResumed:           "tls.resumed",
+			fieldTLSSubject:           "tls.subject",
+			fieldTLSIssuer:            "tls.issuer",
+			fieldTLSNotAfter:          "tls.not_after",
+		},
+		duration: func(d time.Duration) slog.Value {
+			return slog.Int64Value(d.Milliseconds())
+		},
+	},
+	SchemaOTel: {
+		keys: map[eventField]string{
+			fieldMethod:               "http.request.method",
+			fieldURL:                  "url.full",
+			fieldRequestHeaders:       "http.request.header",
+			fieldRequestBody:          "http_log.request.body",
+			fieldRequestBodyEncoding:  "http_log.request.body_encoding",
+			fieldAttempt:              "http.request.resend_count",
+			fieldStatusCode:           "http.response.status_code",
+			fieldProtocol:             "network.protocol.version",
+			fieldResponseHeaders:      "http.response.header",
+			fieldResponseBody:         "http_log.response.body",
+			fieldResponseBodyEncoding: "http_log.response.body_encoding",
+			fieldBytes:                "http.response.body.size",
+			fieldClosedEarly:          "http_log.response.closed_early",
+			fieldError:                "error.message",
+			fieldErrorType:            "error.type",
+			fieldCacheStatus:          "http_log.response.cache_status",
+			fieldDuration:             "http_log.timing.duration",
+			fieldQueueWait:            "http_log.timing.queue_wait",
+			fieldDNSLookup:            "http_log.timing.dns_lookup",
+			fieldDial:                 "http_log.timing.dial",
+			fieldTLSHandshake:         "http_log.timing.tls_handshake",
+			fieldGetConnection:        "http_log.timing.get_connection",
+			fieldServerProcessing:     "http_log.timing.server_processing",
+			fieldTimeToLastByte:       "http_log.timing.time_to_last_byte",
+			fieldConnectionReused:     "http_log.connection.reused",
+			fieldTLSVersion:           "tls.protocol.version",
+			fieldTLSCipher:            "tls.cipher",
+			fieldTLSALPN:              "tls.next_protocol",
+			fieldTLSSNI:               "tls.client.server_name",
+			fieldTLSResumed:           "tls.resumed",
+			fieldTLSSubject:           "tls.server.subject",
+			fieldTLSIssuer:            "tls.server.issuer",
+			fieldTLSNotAfter:          "tls.server.not_after",
+		},
+		duration: func(d time.Duration) slog.Value {
+			return slog.Float64Value(d.Seconds())
+		},
+		headerArrays: true,
+		resendCount:  true,
+	},
+	SchemaECS: {
+		keys: map[eventField]string{
+			fieldMethod:               "http.request.method",
+			fieldURL:                  "url.full",
+			fieldRequestHeaders:       "http.request.headers",
+			fieldRequestBody:          "http.request.body.content",
+			fieldRequestBodyEncoding:  "http.request.body.encoding",
+			fieldAttempt:              "http.request.attempt",
+			fieldStatusCode:           "http.response.status_code",
+			fieldProtocol:             "http.version",
+			fieldResponseHeaders:      "http.response.headers",
+			fieldResponseBody:         "http.response.body.content",
+			fieldResponseBodyEncoding: "http.response.body.encoding",
+			fieldBytes:                "http.response.body.bytes",
+			fieldClosedEarly:          "http.response.closed_early",
+			fieldError:                "error.message",
+			fieldErrorType:            "error.type",
+			fieldCacheStatus:          "http.response.cache_status",
+			fieldDuration:             "event.duration",
+			fieldQueueWait:            "http.timing.queue_wait",
+			fieldDNSLookup:            "http.timing.dns_lookup",
+			fieldDial:                 "http.timing.dial",
+			fieldTLSHandshake:         "http.timing.tls_handshake",
+			fieldGetConnection:        "http.timing.get_connection",
+			fieldServerProcessing:     "http.timing.server_processing",
+			fieldTimeToLastByte:       "http.timing.time_to_last_byte",
+			fieldConnectionReused:     "http.connection.reused",
+			fieldTLSVersion:           "tls.version",
+			fieldTLSCipher:            "tls.cipher",
+			fieldTLSALPN:              "tls.next_protocol",
+			fieldTLSSNI:               "tls.client.server_name",
+			fieldTLSResumed:           "tls.resumed",
+			fieldTLSSubject:           "tls.server.subject",
+			fieldTLSIssuer:            "tls.server.issuer",
+			fieldTLSNotAfter:          "tls.server.not_after",
+		},
+		// ECS durations are in nanoseconds
+		duration: func(d time.Duration) slog.Value {
+			return slog.Int64Value(d.Nanoseconds())
+		},
+	},
+}
+
+// eventBuilder collects the fields of the event, keys missing in the schema are skipped
+type eventBuilder struct {
+	schema schemaDef
+	fields []eventValue
+}
+
+type eventValue struct {
+	path  []string
+	value slog.Value
+}
+
+func (b *eventBuilder) add(field eventField, value slog.Value) {
+	key, ok := b.schema.keys[field]
+	if !ok {
+		return
+	}
+	b.fields = append(b.fields, eventValue{path: strings.Split(key, "."), value: value})
+}
+
+// addHeaders adds the redacted headers, grouped under the key or one field per header with headerArrays
+func (b *eventBuilder) addHeaders(field eventField, redactor Redactor, header http.Header) {
+	if !b.schema.headerArrays {
+		b.add(field, headersValue(redactor, header))
+		return
+	}
+	key, ok := b.schema.keys[field]
+	if !ok {
+		return
+	}
+	path := strings.Split(key, ".")
+	for name, values := range header {
+		redacted := make([]string, 0, len(values))
+		for _, value := range values {
+			redacted = append(redacted, redactor.RedactHeader(name, value))
+		}
+		// a header name may contain a dot, it must not nest the value further
+		b.fields = append(b.fields, eventValue{path: append(slices.Clip(path), strings.ToLower(name)), value: slog.AnyValue(redacted)})
+	}
+}
+
+func (b *eventBuilder) addDuration(field eventField, d time.Duration) {
+	b.add(field, b.schema.duration(d))
+}
+
+// attrs nests the fields into groups by the dotted keys, keeping the order in which the groups appeared
+func (b *eventBuilder) attrs() []slog.Attr {
+	return nestAttrs(b.fields)
+}
+
+func nestAttrs(fields []eventValue) []slog.Attr {
+	var attrs []slog.Attr
+	groups := make(map[string]int) // position of the group in attrs
+	children := make(map[string][]eventValue)
+	for _, f := range fields {
+		if len(f.path) == 1 {
+			attrs = append(attrs, slog.Attr{Key: f.path[0], Value: f.value})
+			continue
+		}
+		name := f.path[0]
+		if _, ok := groups[name]; !ok {
+			groups[name] = len(attrs)
+			attrs = append(attrs, slog.Attr{Key: name})
+		}
+		children[name] = append(children[name], eventValue{path: f.path[1:], value: f.value})
+	}
+	for name, i := range groups {
+		attrs[i].Value = slog.GroupValue(nestAttrs(children[name])...)
+	}
+	return attrs
+}
+
+// logEvent emits the single record describing the whole exchange
+func (t *LoggingTransport) logEvent(ctx context.Context, elog *exchangeLogger, reqInfo *requestInfo) {
+	b := &eventBuilder{schema: schemas[t.schema]}
+
+	b.add(fieldMethod, slog.StringValue(reqInfo.RequestMethod))
+	b.add(fieldURL, slog.StringValue(reqInfo.redactedURL()))
+	if attempt := attemptFromContext(ctx); b.schema.resendCount && attempt > 1 {
+		b.add(fieldAttempt, slog.IntValue(attempt-1))
+	} else if !b.schema.resendCount && attempt > 0 {
+		b.add(fieldAttempt, slog.IntValue(attempt))
+	}
+	b.addHeaders(fieldRequestHeaders, reqInfo.redactor, reqInfo.RequestHeaders)
+	reqInfo.muTrace.Lock()
+	requestBody, requestBodyTruncated, requestBodyEncoding := reqInfo.RequestBody, reqInfo.RequestBodyTruncated, reqInfo.RequestBodyEncoding
+	reqInfo.muTrace.Unlock()
+	if requestBody != nil {
+		body := reqInfo.redactor.RedactBody(reqInfo.RequestHeaders.Get("Content-Type"), requestBody)
+		b.add(fieldRequestBody, slog.StringValue(formatBody(body, requestBodyTruncated)))
+	}
+	if requestBodyEncoding != nil {
+		b.add(fieldRequestBodyEncoding, slog.GroupValue(requestBodyEncoding...))
+	}
+
+	if reqInfo.ResponseErr != nil {
+		b.add(fieldError, slog.StringValue(reqInfo.ResponseErr.Error()))
+		b.add(fieldErrorType, slog.StringValue(reqInfo.ErrorType))
+	} else {
+		b.add(fieldStatus, slog.StringValue(reqInfo.ResponseStatus))
+		b.add(fieldStatusCode, slog.IntValue(reqInfo.ResponseStatusCode))
+		proto := reqInfo.ResponseProto
+		if t.schema != SchemaDefault {
+			proto = protocolVersion(proto)
+		}
+		b.add(fieldProtocol, slog.StringValue(proto))
+		b.addHeaders(fieldResponseHeaders, reqInfo.redactor, reqInfo.ResponseHeaders)
+		if body, truncated, encodingAttrs, ok := t.capturedResponseBody(reqInfo); ok {
+			b.add(fieldResponseBody, slog.StringValue(formatBody(body, truncated)))
+			if encodingAttrs != nil {
+				b.add(fieldResponseBodyEncoding, slog.GroupValue(encodingAttrs...))
+			}
+		}
+	}
+
+	reqInfo.muTrace.Lock()
+	if reqInfo.ResponseErr == nil {
+		b.add(fieldBytes, slog.Int64Value(reqInfo.BytesRead))
+		b.add(fieldClosedEarly, slog.BoolValue(reqInfo.ClosedEarly))
+	}
+	b.addDuration(fieldDuration, reqInfo.Duration)
+	if reqInfo.QueueWait > 0 {
+		b.addDuration(fieldQueueWait, reqInfo.QueueWait)
+	}
+	if reqInfo.CacheStatus != "" {
+		b.add(fieldCacheStatus, slog.StringValue(reqInfo.CacheStatus))
+	}
+	if reqInfo.traced {
+		if !reqInfo.ConnectionReused {
+			b.addDuration(fieldDNSLookup, reqInfo.DNSLookup)
+			b.addDuration(fieldDial, reqInfo.Dialing)
+			b.addDuration(fieldTLSHandshake, reqInfo.TLSHandshake)
+		}
+		b.addDuration(fieldGetConnection, reqInfo.GetConnection)
+		b.addDuration(fieldServerProcessing, reqInfo.ServerProcessing)
+		b.add(fieldConnectionReused, slog.BoolValue(reqInfo.ConnectionReused))
+	}
+	if reqInfo.TimeToLastByte > 0 {
+		b.addDuration(fieldTimeToLastByte, reqInfo.TimeToLastByte)
+	}
+	if state := reqInfo.TLSState; state != nil && reqInfo.TLSErr == nil {
+		t.addTLSFields(b, *state)
+	}
+	reqInfo.muTrace.Unlock()
+
+	elog.event(ctx, t.statusLevels.level(reqInfo), "http exchange", b.attrs()...)
+}
+
+func (t *LoggingTransport) addTLSFields(b *eventBuilder, state tls.ConnectionState) {
+	version := tls.VersionName(state.Version)
+	if t.schema != SchemaDefault {
+		version = protocolVersion(version)
+	}
+	b.add(fieldTLSVersion, slog.StringValue(version))
+	b.add(fieldTLSCipher, slog.StringValue(tls.CipherSuiteName(state.CipherSuite)))
+	b.add(fieldTLSALPN, slog.StringValue(state.NegotiatedProtocol))
+	b.add(fieldTLSSNI, slog.StringValue(state.ServerName))
+	b.add(fieldTLSResumed, slog.BoolValue(state.DidResume))
+	if len(state.PeerCertificates) > 0 {
+		leaf := state.PeerCertificates[0]
+		b.add(fieldTLSSubject, slog.StringValue(leaf.Subject.String()))
+		b.add(fieldTLSIssuer, slog.StringValue(leaf.Issuer.String()))
+		b.add(fieldTLSNotAfter, slog.TimeValue(leaf.NotAfter))
+	}
+}
+
+// protocolVersion keeps only the version of the protocol, e.g. 1.1 for HTTP/1.1 or 1.3 for TLS 1.3,
+// as the semantic conventions do
+func protocolVersion(proto string) string {
+	if version, ok := strings.CutPrefix(proto, "HTTP/"); ok {
+		return version
+	}
+	return strings.TrimPrefix(proto, "TLS ")
+}
+
+// headersValue groups the redacted headers, a header with several values is joined with a comma
+func headersValue(redactor Redactor, header http.Header) slog.Value {
+	attrs := make([]slog.Attr, 0, len(header))
+	for key, values := range header {
+		redacted := make([]string, 0, len(values))
+		for _, value := range values {
+			redacted = append(redacted, redactor.RedactHeader(key, value))
+		}
+		attrs = append(attrs, slog.String(key, strings.Join(redacted, ", ")))
+	}
+	return slog.GroupValue(attrs...)
+}
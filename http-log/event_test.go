@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// logSingleEvent sends the request through a transport emitting the single event and returns the decoded event
+func logSingleEvent(t *testing.T, schema Schema, req *http.Request, options ...Option) map[string]any {
+	t.Helper()
+	var logs syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	client := &http.Client{Transport: NewLoggingTransport(append([]Option{
+		WithLogger(logger),
+		WithRoundTripper(http.DefaultTransport.(*http.Transport).Clone()),
+		WithSingleEvent(schema),
+	}, options...)...)}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var event map[string]any
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("invalid record %s: %v", line, err)
+		}
+		if event["msg"] == "http exchange" {
+			return event
+		}
+	}
+	t.Fatalf("no http exchange event:\n%s", logs.String())
+	return nil
+}
+
+// lookup returns the value at the dotted path of the event
+func lookup(event map[string]any, path string) any {
+	var v any = event
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := io.WriteString(zw, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestEventBodyEncoding(t *testing.T) {
+	response := gzipped(t, `{"answer":"compressed response"}`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(response)
+	}))
+	defer srv.Close()
+
+	request := gzipped(t, `{"question":"compressed request"}`)
+	tests := []struct {
+		schema Schema
+		prefix string
+	}{
+		{SchemaDefault, ""},
+		{SchemaOTel, "http_log."},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, bytes.NewReader(request))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		// asking for gzip leaves the response body encoded
+		req.Header.Set("Accept-Encoding", "gzip")
+		event := logSingleEvent(t, tt.schema, req, WithBodyLogging(1<<20))
+
+		for _, want := range []struct {
+			path  string
+			value any
+		}{
+			{tt.prefix + "request.body", `{"question":"compressed request"}`},
+			{tt.prefix + "request.body_encoding.encoding", "gzip"},
+			{tt.prefix + "request.body_encoding.compressed_bytes", float64(len(request))},
+			{tt.prefix + "request.body_encoding.decompressed_bytes", float64(len(`{"question":"compressed request"}`))},
+			{tt.prefix + "response.body", `{"answer":"compressed response"}`},
+			{tt.prefix + "response.body_encoding.encoding", "gzip"},
+			{tt.prefix + "response.body_encoding.compressed_bytes", float64(len(response))},
+			{tt.prefix + "response.body_encoding.decompressed_bytes", float64(len(`{"answer":"compressed response"}`))},
+		} {
+			if got := lookup(event, want.path); got != want.value {
+				t.Errorf("schema %d: %s = %v, want %v", tt.schema, want.path, got, want.value)
+			}
+		}
+	}
+}
+
+func TestEventResendCount(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	tests := []struct {
+		schema  Schema
+		attempt int
+		path    string
+		want    any
+	}{
+		{SchemaOTel, 1, "http.request.resend_count", nil},
+		{SchemaOTel, 2, "http.request.resend_count", float64(1)},
+		{SchemaDefault, 1, "request.attempt", float64(1)},
+		{SchemaDefault, 2, "request.attempt", float64(2)},
+	}
+	for _, tt := range tests {
+		ctx := context.WithValue(context.Background(), attemptKey{}, tt.attempt)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+		event := logSingleEvent(t, tt.schema, req)
+		if got := lookup(event, tt.path); got != tt.want {
+			t.Errorf("schema %d attempt %d: %s = %v, want %v", tt.schema, tt.attempt, tt.path, got, tt.want)
+		}
+	}
+}
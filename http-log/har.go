@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HARRecorder collects the exchanges seen by LoggingTransport and writes them as a HTTP Archive 1.2 document
+// See http://www.softwareishard.com/blog/har-12-spec/
+// A HAR file is a single JSON document, so the entries are kept in memory and written when Close is called.
+type HARRecorder struct {
+	mu      sync.Mutex
+	w       io.Writer
+	entries []harEntry
+	closed  bool
+}
+
+// NewHARRecorder creates a HARRecorder writing to w, if w is an io.Closer it is closed by Close
+func NewHARRecorder(w io.Writer) *HARRecorder {
+	return &HARRecorder{w: w}
+}
+
+// WithHARRecorder records every exchange in the HARRecorder.
+// The timings block is filled in from the trace of the request, an exchange is recorded once its response body
+// is read or closed so the receive time is known.
+func WithHARRecorder(recorder *HARRecorder) Option {
+	return func(t *LoggingTransport) {
+		t.har = recorder
+	}
+}
+
+var errHARRecorderClosed = errors.New("har recorder closed")
+
+// Record adds the exchange described by requestInfo to the archive
+func (h *HARRecorder) Record(reqInfo *requestInfo) error {
+	entry := newHAREntry(reqInfo)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return errHARRecorderClosed
+	}
+	h.entries = append(h.entries, entry)
+	return nil
+}
+
+// recordHAR adds the exchange to the HARRecorder of the transport
+func (t *LoggingTransport) recordHAR(ctx context.Context, reqInfo *requestInfo, methodAttr, urlAttr slog.Attr) {
+	if err := t.har.Record(reqInfo); err != nil {
+		t.logger.WarnContext(ctx, "HAR recording failed", methodAttr, urlAttr, slog.Any("error", err))
+	}
+}
+
+// Close writes the archive and closes the underlying writer
+func (h *HARRecorder) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return errHARRecorderClosed
+	}
+	h.closed = true
+
+	entries := h.entries
+	if entries == nil {
+		entries = []harEntry{}
+	}
+	doc := harDocument{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "http-log", Version: "1.0"},
+		Entries: entries,
+	}}
+
+	enc := json.NewEncoder(h.w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(doc)
+	if c, ok := h.w.(io.Closer); ok {
+		err = errors.Join(err, c.Close())
+	}
+	return err
+}
+
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Error           string      `json:"_error,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// harTimings are in milliseconds, -1 means the phase does not apply to the request
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+func newHAREntry(reqInfo *requestInfo) harEntry {
+	reqInfo.muTrace.Lock()
+	defer reqInfo.muTrace.Unlock()
+
+	entry := harEntry{
+		StartedDateTime: reqInfo.StartTime.Format("2006-01-02T15:04:05.000Z07:00"),
+		Time:            harMillis(max(reqInfo.Duration, reqInfo.TimeToLastByte)),
+		Request: harRequest{
+			Method:      reqInfo.RequestMethod,
+			URL:         reqInfo.redactedURL(),
+			HTTPVersion: reqInfo.RequestProto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(redactHeaders(reqInfo.redactor, reqInfo.RequestHeaders)),
+			QueryString: harQueryString(reqInfo.redactedURL()),
+			HeadersSize: -1,
+			BodySize:    reqInfo.RequestContentLength,
+		},
+		Response: harResponse{
+			Status:      reqInfo.ResponseStatusCode,
+			StatusText:  http.StatusText(reqInfo.ResponseStatusCode),
+			HTTPVersion: reqInfo.ResponseProto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(redactHeaders(reqInfo.redactor, reqInfo.ResponseHeaders)),
+			// the length of a chunked response is only known once its body is read
+			Content: harContent{
+				Size:     reqInfo.BytesRead,
+				MimeType: reqInfo.ResponseHeaders.Get("Content-Type"),
+			},
+			RedirectURL: reqInfo.ResponseHeaders.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    reqInfo.BytesRead,
+		},
+		Timings: harTimingsOf(reqInfo),
+	}
+	if reqInfo.RequestBody != nil {
+		contentType := reqInfo.RequestHeaders.Get("Content-Type")
+		entry.Request.PostData = &harPostData{
+			MimeType: contentType,
+			Text:     formatBody(reqInfo.redactor.RedactBody(contentType, reqInfo.RequestBody), reqInfo.RequestBodyTruncated),
+		}
+	}
+	if reqInfo.ResponseErr != nil {
+		entry.Error = reqInfo.ResponseErr.Error()
+	}
+	return entry
+}
+
+// harTimingsOf splits the request duration into HAR phases, receive is the download of the response body.
+// Without the detailed timing only the time to the response headers is known and it is reported as wait.
+func harTimingsOf(reqInfo *requestInfo) harTimings {
+	timings := harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1}
+	if reqInfo.TimeToLastByte > reqInfo.Duration {
+		timings.Receive = harMillis(reqInfo.TimeToLastByte - reqInfo.Duration)
+	}
+	if !reqInfo.traced {
+		timings.Wait = harMillis(reqInfo.Duration)
+		return timings
+	}
+
+	// the wait for LimitTransport is blocked time as well
+	connect := reqInfo.Dialing + reqInfo.TLSHandshake
+	if reqInfo.ConnectionReused {
+		timings.Blocked = harMillis(reqInfo.QueueWait + reqInfo.GetConnection)
+	} else {
+		timings.Blocked = harMillis(reqInfo.QueueWait + max(reqInfo.GetConnection-reqInfo.DNSLookup-connect, 0))
+		timings.DNS = harMillis(reqInfo.DNSLookup)
+		timings.Connect = harMillis(connect)
+		if reqInfo.TLSHandshake > 0 {
+			timings.SSL = harMillis(reqInfo.TLSHandshake)
+		}
+	}
+	timings.Send = harMillis(reqInfo.SendRequest)
+	timings.Wait = harMillis(reqInfo.ServerProcessing)
+	return timings
+}
+
+func harMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	values := []harNameValue{}
+	for key, vs := range header {
+		for _, value := range vs {
+			values = append(values, harNameValue{Name: key, Value: value})
+		}
+	}
+	return values
+}
+
+func harQueryString(rawURL string) []harNameValue {
+	values := []harNameValue{}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return values
+	}
+	for key, vs := range u.Query() {
+		for _, value := range vs {
+			values = append(values, harNameValue{Name: key, Value: value})
+		}
+	}
+	return values
+}
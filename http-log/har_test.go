@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHARChunkedResponseSize(t *testing.T) {
+	body := strings.Repeat("chunk ", 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		// flushing before the body is written makes the response chunked
+		w.(http.Flusher).Flush()
+		_, _ = io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	recorder := NewHARRecorder(&out)
+	client := &http.Client{Transport: NewLoggingTransport(WithLogger(discardLogger()), WithHARRecorder(recorder))}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentLength != -1 {
+		t.Fatalf("Content-Length = %d, want a chunked response", resp.ContentLength)
+	}
+	readBody(t, resp)
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc harDocument
+	if err := json.Unmarshal(out.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Log.Entries) != 1 {
+		t.Fatalf("archive has %d entries, want 1", len(doc.Log.Entries))
+	}
+	got := doc.Log.Entries[0].Response
+	if got.Content.Size != int64(len(body)) || got.BodySize != int64(len(body)) {
+		t.Errorf("content.size = %d, bodySize = %d, want %d", got.Content.Size, got.BodySize, len(body))
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrHedgeLost is the cause of the cancellation of the requests which lost to a faster one,
+// LoggingTransport logs them at Debug with the hedge_lost error type
+var ErrHedgeLost = errors.New("hedged request lost")
+
+// HedgingTransport sends a second request when the first one hasn't responded within the hedge delay,
+// and returns whichever response comes first, the other request is cancelled.
+// The delay adapts to the p95 of the recent latencies of the host, as measured by the wrapped LoggingTransport
+// (see WithHedgingRoundTripper), the records of each request then carry the attempt number.
+// Only GET, HEAD and OPTIONS requests without a body, or whose body can be replayed with GetBody, are hedged.
+type HedgingTransport struct {
+	rt           http.RoundTripper
+	logger       *slog.Logger
+	redactor     Redactor
+	maxHedges    int
+	percentile   float64
+	initialDelay time.Duration
+	minDelay     time.Duration
+	maxDelay     time.Duration
+	alternates   []string
+	windowSize   int
+	minSamples   int
+
+	mu        sync.Mutex
+	latencies map[string]*latencyWindow
+}
+
+func NewHedgingTransport(options ...HedgingOption) *HedgingTransport {
+	t := &HedgingTransport{
+		rt:           http.DefaultTransport,
+		logger:       slog.Default(),
+		redactor:     DefaultRedactor(),
+		maxHedges:    1,
+		percentile:   0.95,
+		initialDelay: 100 * time.Millisecond,
+		minDelay:     10 * time.Millisecond,
+		maxDelay:     5 * time.Second,
+		windowSize:   100,
+		minSamples:   20,
+		latencies:    make(map[string]*latencyWindow),
+	}
+
+	for _, option := range options {
+		option(t)
+	}
+
+	return t
+}
+
+type HedgingOption func(transport *HedgingTransport)
+
+func WithHedgingRoundTripper(rt http.RoundTripper) HedgingOption {
+	return func(t *HedgingTransport) {
+		t.rt = rt
+	}
+}
+
+func WithHedgingLogger(logger *slog.Logger) HedgingOption {
+	return func(t *HedgingTransport) {
+		t.logger = logger
+	}
+}
+
+// WithHedgingRedactor sets the redaction policy for the URL in the hedging logs
+func WithHedgingRedactor(redactor Redactor) HedgingOption {
+	return func(t *HedgingTransport) {
+		t.redactor = redactor
+	}
+}
+
+// WithMaxHedges sets how many requests are sent on top of the first one, one by default.
+// Every hedge waits for the delay after the previous one.
+func WithMaxHedges(hedges int) HedgingOption {
+	return func(t *HedgingTransport) {
+		t.maxHedges = hedges
+	}
+}
+
+// WithHedgeDelay sets the percentile of the recent latencies used as the delay (0.95 by default) and its bounds.
+// The initial delay is used until enough latencies of the host are measured.
+func WithHedgeDelay(percentile float64, initial, minDelay, maxDelay time.Duration) HedgingOption {
+	return func(t *HedgingTransport) {
+		t.percentile = percentile
+		t.initialDelay = initial
+		t.minDelay = minDelay
+		t.maxDelay = maxDelay
+	}
+}
+
+// WithAlternateHosts sends the hedges to the hosts in turn instead of the host of the request
+func WithAlternateHosts(hosts ...string) HedgingOption {
+	return func(t *HedgingTransport) {
+		t.alternates = hosts
+	}
+}
+
+// latencyWindow keeps the last latencies of a host in a ring buffer
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % len(w.samples)
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+// sorted returns the latencies in ascending order
+func (w *latencyWindow) sorted() []time.Duration {
+	n := w.next
+	if w.full {
+		n = len(w.samples)
+	}
+	sorted := slices.Clone(w.samples[:n])
+	slices.Sort(sorted)
+	return sorted
+}
+
+// delay returns the hedge delay of the host, the percentile of its latencies within the bounds
+func (t *HedgingTransport) delay(host string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w, ok := t.latencies[host]
+	if !ok {
+		return t.initialDelay
+	}
+	sorted := w.sorted()
+	if len(sorted) < t.minSamples {
+		return t.initialDelay
+	}
+	p := sorted[min(int(float64(len(sorted))*t.percentile), len(sorted)-1)]
+	return min(max(p, t.minDelay), t.maxDelay)
+}
+
+// record adds the latency of the first request to the window of the host.
+// The latency of a first request which lost is not known, the time it ran for is recorded instead.
+func (t *HedgingTransport) record(host string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w, ok := t.latencies[host]
+	if !ok {
+		w = &latencyWindow{samples: make([]time.Duration, max(t.windowSize, 1))}
+		t.latencies[host] = w
+	}
+	w.add(d)
+}
+
+// estimateSaved returns how much a hedge answering after elapsed saved, from the mean latency
+// of the first requests which took longer than that. It's false when no such request was measured.
+func (t *HedgingTransport) estimateSaved(host string, elapsed time.Duration) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w, ok := t.latencies[host]
+	if !ok {
+		return 0, false
+	}
+	var sum time.Duration
+	var n int
+	for _, d := range w.sorted() {
+		if d > elapsed {
+			sum += d
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return sum/time.Duration(n) - elapsed, true
+}
+
+// hedgeable reports whether the request may be sent more than once at the same time
+func hedgeable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+	}
+	return false
+}
+
+// hedgeResult is the outcome of one of the requests
+type hedgeResult struct {
+	attempt int
+	resp    *http.Response
+	err     error
+	latency time.Duration
+	capture *requestInfoCapture
+}
+
+func (t *HedgingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !hedgeable(r) || t.maxHedges < 1 {
+		return t.rt.RoundTrip(r)
+	}
+
+	rCtx := r.Context()
+	host := r.URL.Host
+	delay := t.delay(host)
+	methodAttr := slog.String("method", r.Method)
+	urlAttr := slog.String("url", t.redactor.RedactURL(r.URL))
+
+	start := time.Now()
+	results := make(chan hedgeResult, t.maxHedges+1)
+	cancels := make(map[int]context.CancelCauseFunc, t.maxHedges+1)
+	send := func(attempt int) error {
+		req, cancel, capture, err := t.attemptRequest(r, attempt)
+		if err != nil {
+			return err
+		}
+		cancels[attempt] = cancel
+		go func() {
+			attemptStart := time.Now()
+			resp, err := t.rt.RoundTrip(req)
+			results <- hedgeResult{attempt: attempt, resp: resp, err: err, latency: time.Since(attemptStart), capture: capture}
+		}()
+		return nil
+	}
+
+	if err := send(1); err != nil {
+		return nil, err
+	}
+	sent, pending := 1, 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var lastErr error
+	for {
+		select {
+		case <-timer.C:
+			if rCtx.Err() != nil {
+				continue
+			}
+			t.logger.DebugContext(rCtx, "hedging request", methodAttr, urlAttr, slog.Int("attempt", sent+1), slog.Duration("delay", delay))
+			if err := send(sent + 1); err != nil {
+				t.logger.WarnContext(rCtx, "hedging request failed", methodAttr, urlAttr, slog.Any("error", err))
+				continue
+			}
+			sent++
+			pending++
+			if sent <= t.maxHedges {
+				timer.Reset(delay)
+			}
+
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				cancels[res.attempt](nil)
+				lastErr = res.err
+				// a failure is an answer as well, retrying it is left to RetryTransport
+				if pending == 0 {
+					return nil, lastErr
+				}
+				continue
+			}
+
+			elapsed := time.Since(start)
+			for attempt, cancel := range cancels {
+				if attempt != res.attempt {
+					cancel(ErrHedgeLost)
+				}
+			}
+			// the losers may still answer before they notice the cancellation
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if late := <-results; late.resp != nil {
+						late.resp.Body.Close()
+					}
+				}
+			}(pending)
+
+			t.won(rCtx, host, res, sent, elapsed, methodAttr, urlAttr)
+			// the winner runs until its body is read or closed
+			cancel := cancels[res.attempt]
+			res.resp.Body = &releaseBody{ReadCloser: res.resp.Body, release: func() { cancel(nil) }}
+			return res.resp, nil
+		}
+	}
+}
+
+// attemptRequest returns the request of the attempt with its own context, so it can be cancelled alone.
+// The hedges go to the alternate hosts when there are some.
+func (t *HedgingTransport) attemptRequest(r *http.Request, attempt int) (*http.Request, context.CancelCauseFunc, *requestInfoCapture, error) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	ctx = context.WithValue(ctx, attemptKey{}, attempt)
+	ctx, capture := withRequestInfoCapture(ctx)
+
+	req := r.Clone(ctx)
+	if attempt > 1 {
+		if r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				cancel(nil)
+				return nil, nil, nil, err
+			}
+			req.Body = body
+		}
+		if len(t.alternates) > 0 {
+			req.URL.Host = t.alternates[(attempt-2)%len(t.alternates)]
+			req.Host = ""
+		}
+	}
+	return req, cancel, capture, nil
+}
+
+// won records the latency of the first request, logs the outcome when a hedge was sent
+// and passes the requestInfo of the winner to the caller
+func (t *HedgingTransport) won(ctx context.Context, host string, res hedgeResult, sent int, elapsed time.Duration, methodAttr, urlAttr slog.Attr) {
+	latency := res.latency
+	if reqInfo := res.capture.reqInfo; reqInfo != nil {
+		captureRequestInfo(ctx, reqInfo)
+		// the latency measured by LoggingTransport leaves out the time spent in the hedging transport
+		latency = reqInfo.Duration
+	}
+	if res.attempt == 1 {
+		t.record(host, latency)
+	} else {
+		t.record(host, elapsed)
+	}
+
+	if sent == 1 {
+		return
+	}
+	attrs := []any{methodAttr, urlAttr, slog.Int("winner", res.attempt), slog.Int("attempts", sent), slog.Int64("Duration_ms", elapsed.Milliseconds())}
+	if res.attempt > 1 {
+		if saved, ok := t.estimateSaved(host, elapsed); ok {
+			attrs = append(attrs, slog.Int64("saved_ms", saved.Milliseconds()))
+		}
+	} else {
+		attrs = append(attrs, slog.Int64("saved_ms", 0))
+	}
+	t.logger.InfoContext(ctx, "hedged request completed", attrs...)
+}
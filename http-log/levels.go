@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// StatusLevels maps the outcome of the exchange to the level of the response record
+type StatusLevels struct {
+	Success        slog.Level // 1xx, 2xx and 3xx
+	ClientError    slog.Level // 4xx
+	ServerError    slog.Level // 5xx
+	TransportError slog.Level // no response was received
+	Rejected       slog.Level // the request was failed fast by CircuitBreakerTransport or LimitTransport without being sent
+}
+
+// DefaultStatusLevels logs successful responses at Info, 4xx at Warn, 5xx and transport errors at Error.
+// Rejected requests are logged at Debug, the circuit breaker logs its state changes instead.
+func DefaultStatusLevels() StatusLevels {
+	return StatusLevels{
+		Success:        slog.LevelInfo,
+		ClientError:    slog.LevelWarn,
+		ServerError:    slog.LevelError,
+		TransportError: slog.LevelError,
+		Rejected:       slog.LevelDebug,
+	}
+}
+
+// WithStatusLevels replaces the levels of the response record
+func WithStatusLevels(levels StatusLevels) Option {
+	return func(t *LoggingTransport) {
+		t.statusLevels = levels
+	}
+}
+
+// level returns the level of the response record for the exchange, the losers of hedged requests are logged at Debug
+func (l StatusLevels) level(reqInfo *requestInfo) slog.Level {
+	switch {
+	case reqInfo.ErrorType == ErrorTypeHedgeLost:
+		return slog.LevelDebug
+	case reqInfo.ErrorType == ErrorTypeCircuitOpen, reqInfo.ErrorType == ErrorTypeLimitQueueFull:
+		return l.Rejected
+	case reqInfo.ResponseErr != nil:
+		return l.TransportError
+	case reqInfo.ResponseStatusCode >= http.StatusInternalServerError:
+		return l.ServerError
+	case reqInfo.ResponseStatusCode >= http.StatusBadRequest:
+		return l.ClientError
+	}
+	return l.Success
+}
+
+// Error types of the transport errors, logged as error.type so alerts do not depend on the error messages
+const (
+	ErrorTypeDNSNotFound       = "dns_not_found"
+	ErrorTypeConnectionRefused = "connection_refused"
+	ErrorTypeTimeout           = "timeout"
+	ErrorTypeContextCanceled   = "context_canceled"
+	ErrorTypeTLS               = "tls_error"
+	ErrorTypeResetByPeer       = "reset_by_peer"
+	ErrorTypeHedgeLost         = "hedge_lost"       // cancelled by HedgingTransport because another request answered first
+	ErrorTypeCircuitOpen       = "circuit_open"     // failed fast by CircuitBreakerTransport, see ErrCircuitOpen
+	ErrorTypeLimitQueueFull    = "limit_queue_full" // failed fast by LimitTransport, see ErrLimitQueueFull
+	// ErrorTypeOther is used for errors which do not fit any other type, as in the OpenTelemetry semantic conventions
+	ErrorTypeOther = "_OTHER"
+)
+
+// classifyError returns the error type of a transport error.
+// The context of the request is checked as well, http.Client reports its own timeout as a canceled request.
+func classifyError(ctx context.Context, err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+
+	switch {
+	case errors.Is(context.Cause(ctx), ErrHedgeLost):
+		return ErrorTypeHedgeLost
+	case errors.Is(err, ErrCircuitOpen):
+		return ErrorTypeCircuitOpen
+	case errors.Is(err, ErrLimitQueueFull):
+		return ErrorTypeLimitQueueFull
+	case errors.Is(ctx.Err(), context.DeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return ErrorTypeTimeout
+	case errors.Is(ctx.Err(), context.Canceled), errors.Is(err, context.Canceled):
+		return ErrorTypeContextCanceled
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return ErrorTypeDNSNotFound
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTypeTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorTypeConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET):
+		return ErrorTypeResetByPeer
+	case errors.As(err, &certErr), errors.As(err, &alertErr), errors.As(err, &recordErr),
+		errors.As(err, &unknownAuthority), errors.As(err, &hostname), errors.As(err, &invalid):
+		return ErrorTypeTLS
+	}
+	return ErrorTypeOther
+}
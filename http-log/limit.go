@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrLimitQueueFull is returned without sending the request when too many requests already wait for the limit
+var ErrLimitQueueFull = errors.New("limit queue is full")
+
+// LimitTransport limits the rate and the number of requests in flight per host, or per key returned by the key function.
+// Requests over the limit wait until the context is done, the wait is recorded as the QueueWait timing phase
+// when LimitTransport is wrapped by a LoggingTransport (see WithRoundTripper).
+// A request stays in flight until its response body is read to the end or closed.
+type LimitTransport struct {
+	rt          http.RoundTripper
+	rate        float64 // requests per second, 0 means no rate limit
+	burst       int
+	maxInFlight int // 0 means no limit
+	maxQueue    int // 0 means no limit
+	key         func(r *http.Request) string
+
+	mu     sync.Mutex
+	limits map[string]*limiter
+}
+
+func NewLimitTransport(options ...LimitOption) *LimitTransport {
+	t := &LimitTransport{
+		rt:     http.DefaultTransport,
+		key:    func(r *http.Request) string { return r.URL.Host },
+		limits: make(map[string]*limiter),
+	}
+
+	for _, option := range options {
+		option(t)
+	}
+
+	return t
+}
+
+type LimitOption func(transport *LimitTransport)
+
+func WithLimitRoundTripper(rt http.RoundTripper) LimitOption {
+	return func(t *LimitTransport) {
+		t.rt = rt
+	}
+}
+
+// WithRateLimit allows perSecond requests per second on average, with bursts of up to burst requests
+func WithRateLimit(perSecond float64, burst int) LimitOption {
+	return func(t *LimitTransport) {
+		t.rate = perSecond
+		t.burst = max(burst, 1)
+	}
+}
+
+// WithMaxInFlight limits the number of requests sent at the same time
+func WithMaxInFlight(requests int) LimitOption {
+	return func(t *LimitTransport) {
+		t.maxInFlight = requests
+	}
+}
+
+// WithMaxQueue fails requests with ErrLimitQueueFull when the given number of requests already wait
+func WithMaxQueue(requests int) LimitOption {
+	return func(t *LimitTransport) {
+		t.maxQueue = requests
+	}
+}
+
+// WithLimitKey limits the requests grouped by the key instead of by the host
+func WithLimitKey(key func(r *http.Request) string) LimitOption {
+	return func(t *LimitTransport) {
+		t.key = key
+	}
+}
+
+// limiter holds the token bucket and the in-flight slots of a single key
+type limiter struct {
+	slots chan struct{} // nil without the in-flight limit
+
+	mu     sync.Mutex
+	tokens float64 // negative when requests reserved future tokens
+	last   time.Time
+	queued int
+}
+
+func (t *LimitTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rCtx := r.Context()
+	key := t.key(r)
+	l := t.limiter(key)
+
+	start := time.Now()
+	err := t.wait(rCtx, l, key)
+	if reqInfo := requestInfoFromContext(rCtx); reqInfo != nil {
+		reqInfo.muTrace.Lock()
+		reqInfo.QueueWait = time.Since(start)
+		reqInfo.muTrace.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.rt.RoundTrip(r)
+	if l.slots == nil {
+		return resp, err
+	}
+	if err != nil || resp.Body == nil || resp.Body == http.NoBody || resp.StatusCode == http.StatusSwitchingProtocols {
+		<-l.slots
+		return resp, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { <-l.slots }}
+	return resp, nil
+}
+
+func (t *LimitTransport) limiter(key string) *limiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l, ok := t.limits[key]
+	if !ok {
+		l = &limiter{tokens: float64(t.burst), last: time.Now()}
+		if t.maxInFlight > 0 {
+			l.slots = make(chan struct{}, t.maxInFlight)
+		}
+		t.limits[key] = l
+	}
+	return l
+}
+
+// wait blocks until the request may be sent, holding an in-flight slot when it returns without an error
+func (t *LimitTransport) wait(ctx context.Context, l *limiter, key string) error {
+	l.mu.Lock()
+	if t.maxQueue > 0 && l.queued >= t.maxQueue {
+		l.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrLimitQueueFull, key)
+	}
+	l.queued++
+	delay := t.reserve(l)
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		l.mu.Unlock()
+	}()
+
+	if delay > 0 {
+		// fail right away when the request would be sent after its deadline
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			t.cancelReservation(l)
+			return fmt.Errorf("rate limit wait of %s exceeds the deadline: %w", delay, context.DeadlineExceeded)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			t.cancelReservation(l)
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if l.slots == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve takes a token and returns how long to wait until it's available, it must be called with the lock held
+func (t *LimitTransport) reserve(l *limiter) time.Duration {
+	if t.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*t.rate, float64(t.burst))
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / t.rate * float64(time.Second))
+}
+
+// cancelReservation returns the token taken by a request which is not sent
+func (t *LimitTransport) cancelReservation(l *limiter) {
+	if t.rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = min(l.tokens+1, float64(t.burst))
+}
+
+// releaseBody calls release once, when the body hits EOF or when it's closed
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
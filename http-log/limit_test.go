@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingServer answers once release is closed, it counts the requests in progress
+func blockingServer(t *testing.T, release chan struct{}, inProgress *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inProgress.Add(1)
+		defer inProgress.Add(-1)
+		<-release
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLimitQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	var inProgress atomic.Int32
+	srv := blockingServer(t, release, &inProgress)
+	limit := NewLimitTransport(WithMaxInFlight(1), WithMaxQueue(1))
+
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	client := &http.Client{Transport: NewLoggingTransport(WithLogger(logger), WithRoundTripper(limit))}
+
+	// the first request is in flight and the second one waits for its slot
+	done := make(chan error, 2)
+	for range 2 {
+		go func() {
+			resp, err := client.Get(srv.URL)
+			if err == nil {
+				_, err = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			done <- err
+		}()
+	}
+	l := limit.limiter(strings.TrimPrefix(srv.URL, "http://"))
+	for {
+		l.mu.Lock()
+		queued := l.queued
+		l.mu.Unlock()
+		if inProgress.Load() == 1 && queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := client.Get(srv.URL); !errors.Is(err, ErrLimitQueueFull) {
+		t.Errorf("third request: %v, want ErrLimitQueueFull", err)
+	}
+	close(release)
+	for range 2 {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+
+	out := logs.String()
+	var rejected string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "error.type=") {
+			rejected = line
+		}
+	}
+	if !strings.Contains(rejected, "level=DEBUG") || !strings.Contains(rejected, "error.type="+ErrorTypeLimitQueueFull) {
+		t.Errorf("rejected request is logged as\n%s\nwant Debug with error.type=%s", rejected, ErrorTypeLimitQueueFull)
+	}
+}
+
+func TestLimitMaxInFlight(t *testing.T) {
+	release := make(chan struct{})
+	var inProgress, maxSeen atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inProgress.Add(1)
+		defer inProgress.Add(-1)
+		for {
+			seen := maxSeen.Load()
+			if n <= seen || maxSeen.CompareAndSwap(seen, n) {
+				break
+			}
+		}
+		<-release
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: NewLimitTransport(WithMaxInFlight(2))}
+
+	done := make(chan error, 5)
+	for range 5 {
+		go func() {
+			resp, err := client.Get(srv.URL)
+			if err == nil {
+				// the slot is released when the body is closed
+				err = resp.Body.Close()
+			}
+			done <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := inProgress.Load(); n != 2 {
+		t.Errorf("%d requests in flight, want 2", n)
+	}
+	close(release)
+	for range 5 {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+	if maxSeen.Load() != 2 {
+		t.Errorf("up to %d requests were in flight, want 2", maxSeen.Load())
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	client := &http.Client{Transport: NewLoggingTransport(
+		WithLogger(discardLogger()),
+		WithRoundTripper(NewLimitTransport(WithRateLimit(20, 1))),
+	)}
+
+	// the burst lets the first request through, the next ones wait 50ms each
+	var waits []time.Duration
+	start := time.Now()
+	for range 3 {
+		ctx, capture := withRequestInfoCapture(t.Context())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		waits = append(waits, capture.reqInfo.QueueWait)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("3 requests took %v, want at least 100ms at 20 per second", elapsed)
+	}
+	if waits[0] > 10*time.Millisecond || waits[2] < 20*time.Millisecond {
+		t.Errorf("queue waits = %v, want none for the first request and about 50ms for the others", waits)
+	}
+}
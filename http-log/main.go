@@ -3,15 +3,17 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"flag"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptrace"
+	"net/url"
 	"os"
-	"strings"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type LoggingTransport struct {
@@ -19,6 +21,24 @@ type LoggingTransport struct {
 	logger              *slog.Logger
 	detailedTiming      bool
 	detailedTimingLevel slog.Level
+	bodyLogging         bool
+	maxBodyBytes        int64
+	bodyContentTypes    []string
+	har                 *HARRecorder
+	redactor            Redactor
+	metrics             *transportMetrics
+	logPolicy           LogPolicy
+	dropped             *droppedLogs
+	singleEvent         bool
+	schema              Schema
+	tracing             bool
+	recent              *RecentRequests
+	minLevel            slog.Leveler
+	pool                *poolStats
+	reproduceFormats    []ReproduceFormat
+	contextHeaders      []contextHeader
+	statusLevels        StatusLevels
+	summaries           *summaryLoops
 }
 
 func NewLoggingTransport(options ...Option) *LoggingTransport {
@@ -26,15 +46,68 @@ func NewLoggingTransport(options ...Option) *LoggingTransport {
 		rt:             http.DefaultTransport,
 		logger:         slog.Default(),
 		detailedTiming: false,
+		redactor:       DefaultRedactor(),
+		statusLevels:   DefaultStatusLevels(),
 	}
 
 	for _, option := range options {
 		option(t)
 	}
 
+	t.startSummaries()
 	return t
 }
 
+// summaryLoops log the dropped records and the pool counters periodically, until Close
+type summaryLoops struct {
+	stop chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// startSummaries starts a goroutine per summary, once the options set the logger
+func (t *LoggingTransport) startSummaries() {
+	t.summaries = &summaryLoops{stop: make(chan struct{})}
+	if t.dropped != nil {
+		t.summaries.run(t.dropped.interval, func() { t.dropped.logSummary(context.Background(), t.logger) })
+	}
+	if t.pool != nil {
+		t.summaries.run(t.pool.interval, func() { t.pool.logSummary(context.Background(), t.logger) })
+	}
+}
+
+// run calls logSummary every interval, and a last time when the loops are stopped so the last counts are logged.
+// Without a positive interval the summary is only logged when they are stopped.
+func (s *summaryLoops) run(interval time.Duration, logSummary func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-tick:
+				logSummary()
+			case <-s.stop:
+				logSummary()
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the periodic summaries of WithLogPolicy and WithPoolStats after logging them a last time.
+// The transport keeps sending requests after Close.
+func (t *LoggingTransport) Close() error {
+	t.summaries.once.Do(func() { close(t.summaries.stop) })
+	t.summaries.wg.Wait()
+	return nil
+}
+
 type Option func(transport *LoggingTransport)
 
 func WithRoundTripper(rt http.RoundTripper) Option {
@@ -56,160 +129,321 @@ func WithDetailedTiming(level slog.Level) Option {
 	}
 }
 
-// RoundTrip logs the request & response data, if the detailed timing is set, it logs it as well
-// code adopted from https://github.com/kubernetes/kubernetes/blob/master/staging/src/k8s.io/client-go/transport/round_trippers.go#L459
+// WithBodyLogging logs request and response bodies up to maxBytes, longer bodies are truncated.
+// Only bodies matching contentTypes are logged, by default only textual content types are.
+// The request body is logged once the transport sent it and the response body when the caller closes it,
+// both are copied as they are read so streaming bodies keep working.
+// Bodies with a gzip, deflate, br or zstd Content-Encoding are decoded for the log only, up to maxBytes,
+// the records report their compressed and decompressed sizes.
+func WithBodyLogging(maxBytes int64, contentTypes ...string) Option {
+	return func(t *LoggingTransport) {
+		if len(contentTypes) == 0 {
+			contentTypes = defaultBodyContentTypes
+		}
+		t.bodyLogging = true
+		t.maxBodyBytes = maxBytes
+		t.bodyContentTypes = contentTypes
+	}
+}
+
+// RoundTrip logs the request & response data, if the detailed timing is set, it logs it as well.
+// The options can be overridden for a single request with WithOptions.
 func (t *LoggingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.forRequest(r.Context()).roundTrip(r)
+}
+
+// code adopted from https://github.com/kubernetes/kubernetes/blob/master/staging/src/k8s.io/client-go/transport/round_trippers.go#L459
+func (t *LoggingTransport) roundTrip(r *http.Request) (*http.Response, error) {
+	r = t.withContextHeaders(r)
+	var span trace.Span
+	if t.tracing {
+		r, span = t.startSpan(r)
+	}
 	rCtx := r.Context()
 
-	reqInfo := newRequestInfo(r)
+	reqInfo := newRequestInfo(r, t.redactor)
+	elog := newExchangeLogger(t.logger, t.logPolicy != nil)
+	elog.muted = t.singleEvent
+	elog.minLevel = t.minLevel
+	captureRequestInfo(rCtx, reqInfo)
+	elog.with(t.contextAttrs(rCtx)...)
+	if sc := trace.SpanContextFromContext(rCtx); t.tracing && sc.IsValid() {
+		elog.with(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
 
 	methodAttr := slog.String("method", reqInfo.RequestMethod)
-	urlAttr := slog.String("url", reqInfo.RequestURL)
-	t.logger.DebugContext(rCtx, "request info", methodAttr, urlAttr)
+	urlAttr := slog.String("url", reqInfo.redactedURL())
+	if attempt := attemptFromContext(rCtx); attempt > 0 {
+		// attempts made by RetryTransport are logged as part of one logical request
+		elog.with(slog.Int("attempt", attempt))
+	}
+	elog.Log(rCtx, slog.LevelDebug, "request info", methodAttr, urlAttr)
 
 	var headers []any
 	for key, values := range reqInfo.RequestHeaders {
 		for _, value := range values {
-			value = maskValue(key, value)
+			value = t.redactor.RedactHeader(key, value)
 			headers = append(headers, slog.String(key, value))
 		}
 	}
 
-	t.logger.DebugContext(rCtx, "request headers", headers...)
+	elog.Log(rCtx, slog.LevelDebug, "request headers", headers...)
+
+	reproduce := t.reproduceFormats != nil && !elog.muted && elog.enabled(rCtx, LevelTrace)
+	captured := false
+	if t.bodyLogging {
+		header, contentLength := r.Header, r.ContentLength
+		r, captured = captureRequestBody(r, t.maxBodyBytes, t.bodyContentTypes, func(body []byte, truncated bool, read int64) {
+			t.logRequestBody(rCtx, elog, reqInfo, header, body, truncated, max(read, contentLength), methodAttr, urlAttr)
+			// the reproduction of a captured body is logged once the body was sent
+			if reproduce {
+				t.logReproductions(rCtx, elog, reqInfo, methodAttr, urlAttr)
+			}
+		})
+	}
+	if reproduce && !captured {
+		t.logReproductions(rCtx, elog, reqInfo, methodAttr, urlAttr)
+	}
 
 	startTime := time.Now()
+	reqInfo.StartTime = startTime
 
-	if t.detailedTiming {
-		var getConn, dnsStart, dialStart, tlsStart, serverStart time.Time
-		var host string
-		trace := &httptrace.ClientTrace{
-			// DNS
-			DNSStart: func(info httptrace.DNSStartInfo) {
-				reqInfo.muTrace.Lock()
-				defer reqInfo.muTrace.Unlock()
-				dnsStart = time.Now()
-				host = info.Host
-			},
-			DNSDone: func(info httptrace.DNSDoneInfo) {
-				reqInfo.muTrace.Lock()
-				defer reqInfo.muTrace.Unlock()
-				reqInfo.DNSLookup = time.Since(dnsStart)
-				t.logger.Log(rCtx, t.detailedTimingLevel, "HTTP Trace", slog.String("DNS_lookup", host), slog.String("resolved", fmt.Sprintf("%v", info.Addrs)))
-			},
-			// Dial
-			ConnectStart: func(network, addr string) {
-				reqInfo.muTrace.Lock()
-				defer reqInfo.muTrace.Unlock()
-				dialStart = time.Now()
-			},
-			ConnectDone: func(network, addr string, err error) {
-				reqInfo.muTrace.Lock()
-				defer reqInfo.muTrace.Unlock()
-				reqInfo.Dialing = time.Since(dialStart)
-				if err != nil {
-					t.logger.Log(rCtx, t.detailedTimingLevel, "HTTP Trace: Dial failed", slog.String("network", network), slog.String("addr", addr), slog.Any("error", err))
-				} else {
-					t.logger.Log(rCtx, t.detailedTimingLevel, "HTTP Trace: Dial succeed", slog.String("network", network), slog.String("addr", addr))
-				}
-			},
-			// TLS
-			TLSHandshakeStart: func() {
-				tlsStart = time.Now()
-			},
-			TLSHandshakeDone: func(_ tls.ConnectionState, _ error) {
-				reqInfo.muTrace.Lock()
-				defer reqInfo.muTrace.Unlock()
-				reqInfo.TLSHandshake = time.Since(tlsStart)
-			},
-			// Connection (it can be DNS + Dial or just the time to get one from the connection pool)
-			GetConn: func(hostPort string) {
-				getConn = time.Now()
-			},
-			GotConn: func(info httptrace.GotConnInfo) {
-				reqInfo.muTrace.Lock()
-				defer reqInfo.muTrace.Unlock()
-				reqInfo.GetConnection = time.Since(getConn)
-				reqInfo.ConnectionReused = info.Reused
-			},
-			// Server Processing (time since we wrote the request until first byte is received)
-			WroteRequest: func(info httptrace.WroteRequestInfo) {
-				reqInfo.muTrace.Lock()
-				defer reqInfo.muTrace.Unlock()
-				serverStart = time.Now()
-			},
-			GotFirstResponseByte: func() {
-				reqInfo.muTrace.Lock()
-				defer reqInfo.muTrace.Unlock()
-				reqInfo.ServerProcessing = time.Since(serverStart)
-			},
-		}
-		r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+	if t.traceEnabled() {
+		reqInfo.traced = true
+		r = r.WithContext(httptrace.WithClientTrace(r.Context(), t.clientTrace(rCtx, elog, reqInfo)))
+	}
+	if span != nil {
+		r = r.WithContext(withSpanTrace(r.Context(), span))
 	}
+	r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, reqInfo))
 
 	resp, err := t.rt.RoundTrip(r)
 	reqInfo.Duration = time.Since(startTime)
 
 	reqInfo.complete(resp, err)
+	if err != nil {
+		reqInfo.ErrorType = classifyError(rCtx, err)
+	}
 
-	t.logger.InfoContext(rCtx, "response", methodAttr, urlAttr, slog.String("status", reqInfo.ResponseStatus), slog.Int64("Duration_ms", reqInfo.Duration.Nanoseconds()/int64(time.Millisecond)))
+	level := t.statusLevels.level(reqInfo)
+	durationAttr := slog.Int64("Duration_ms", reqInfo.Duration.Nanoseconds()/int64(time.Millisecond))
+	msg := "response"
+	attrs := []any{methodAttr, urlAttr}
+	if err != nil {
+		msg = "request failed"
+		attrs = append(attrs, slog.String("error.type", reqInfo.ErrorType), slog.Any("error", err))
+	} else {
+		attrs = append(attrs, slog.String("status", reqInfo.ResponseStatus))
+	}
+	attrs = append(attrs, durationAttr)
+	if reqInfo.CacheStatus != "" {
+		attrs = append(attrs, slog.String("cache_status", reqInfo.CacheStatus))
+	}
+	elog.Log(rCtx, level, msg, attrs...)
 
 	if t.detailedTiming {
-		var stats []slog.Attr
-		if !reqInfo.ConnectionReused {
-			stats = append(stats, slog.Int64("DNSLookup_ms", reqInfo.DNSLookup.Nanoseconds()/int64(time.Millisecond)))
-			stats = append(stats, slog.Int64("Dial_ms", reqInfo.Dialing.Nanoseconds()/int64(time.Millisecond)))
-			stats = append(stats, slog.Int64("TLSHandshake_ms", reqInfo.TLSHandshake.Nanoseconds()/int64(time.Millisecond)))
-		} else {
-			stats = append(stats, slog.Int64("GetConnection_ms", reqInfo.GetConnection.Nanoseconds()/int64(time.Millisecond)))
-		}
-		if reqInfo.ServerProcessing != 0 {
-			stats = append(stats, slog.Int64("ServerProcessing_ms", reqInfo.ServerProcessing.Nanoseconds()/int64(time.Millisecond)))
-		}
-		stats = append(stats, slog.Int64("Duration_ms", reqInfo.Duration.Nanoseconds()/int64(time.Millisecond)))
-		t.logger.LogAttrs(rCtx, t.detailedTimingLevel, "HTTP statistics", stats...)
+		elog.LogAttrs(rCtx, t.detailedTimingLevel, "HTTP statistics", reqInfo.statistics()...)
 
 		var responseHeaders []slog.Attr
 		for key, values := range reqInfo.ResponseHeaders {
 			for _, value := range values {
-				value = maskValue(key, value)
+				value = t.redactor.RedactHeader(key, value)
 				responseHeaders = append(responseHeaders, slog.String(key, value))
 			}
 		}
-		t.logger.LogAttrs(rCtx, slog.LevelDebug, "response headers", responseHeaders...)
+		elog.LogAttrs(rCtx, slog.LevelDebug, "response headers", responseHeaders...)
+	}
+
+	if t.logPolicy != nil {
+		emit := t.logPolicy.ShouldLog(reqInfo)
+		elog.decide(rCtx, emit)
+		if !emit {
+			t.dropped.add(reqInfo.requestURL.Host)
+		}
+	}
+
+	if t.bodyLogging && err == nil {
+		t.logResponseBody(rCtx, elog, reqInfo, resp, methodAttr, urlAttr)
 	}
 
+	if err == nil {
+		resp = t.trackTransfer(rCtx, elog, reqInfo, resp, methodAttr, urlAttr)
+	}
+
+	if t.singleEvent && !reqInfo.transferTracked {
+		t.logEvent(rCtx, elog, reqInfo)
+	}
+
+	if t.metrics != nil {
+		t.metrics.record(rCtx, reqInfo)
+	}
+
+	// the entry of a tracked body is recorded once the body is read, with the receive time
+	if t.har != nil && !reqInfo.transferTracked {
+		t.recordHAR(rCtx, reqInfo, methodAttr, urlAttr)
+	}
+
+	if t.recent != nil {
+		t.recent.Record(reqInfo)
+	}
+
+	endSpan(span, reqInfo)
+
 	return resp, err
 }
 
+// traceEnabled reports whether the timing of the request phases has to be collected
+func (t *LoggingTransport) traceEnabled() bool {
+	return t.detailedTiming || t.har != nil || t.metrics != nil || t.recent != nil || t.pool != nil
+}
+
+// logResponseBody wraps the response body so it is logged once the caller closes it
+func (t *LoggingTransport) logResponseBody(ctx context.Context, elog *exchangeLogger, reqInfo *requestInfo, resp *http.Response, methodAttr, urlAttr slog.Attr) {
+	if resp.Body == nil || resp.Body == http.NoBody || resp.StatusCode == http.StatusSwitchingProtocols {
+		return
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType != "" && !loggableContentType(contentType, t.bodyContentTypes) {
+		return
+	}
+	statusAttr := slog.String("status", resp.Status)
+	bl := newBodyLogger(resp.Body, t.maxBodyBytes, func(body []byte, truncated bool, read int64) {
+		body, truncated, encodingAttrs, ok := t.decodeCapturedBody(resp.Header, body, truncated, read)
+		if !ok {
+			return
+		}
+		body = t.redactor.RedactBody(contentType, body)
+		attrs := append([]slog.Attr{methodAttr, urlAttr, statusAttr, slog.String("body", formatBody(body, truncated)), slog.Bool("truncated", truncated)}, encodingAttrs...)
+		elog.LogAttrs(ctx, slog.LevelDebug, "response body", attrs...)
+	})
+	resp.Body = bl
+	reqInfo.responseCapture = bl
+}
+
+// logRequestBody logs the request body captured while the wrapped RoundTripper sent it
+func (t *LoggingTransport) logRequestBody(ctx context.Context, elog *exchangeLogger, reqInfo *requestInfo, header http.Header, raw []byte, truncated bool, compressedBytes int64, methodAttr, urlAttr slog.Attr) {
+	body, truncated, encodingAttrs, ok := t.decodeCapturedBody(header, raw, truncated, compressedBytes)
+	if !ok {
+		return
+	}
+	reqInfo.muTrace.Lock()
+	reqInfo.RequestBody = body
+	reqInfo.RequestBodyTruncated = truncated
+	reqInfo.RequestBodyEncoding = encodingAttrs
+	reqInfo.muTrace.Unlock()
+
+	body = t.redactor.RedactBody(header.Get("Content-Type"), body)
+	attrs := append([]slog.Attr{methodAttr, urlAttr, slog.String("body", formatBody(body, truncated)), slog.Bool("truncated", truncated)}, encodingAttrs...)
+	elog.LogAttrs(ctx, slog.LevelDebug, "request body", attrs...)
+}
+
+// logReproductions logs the reproduction of the request in every format of WithReproduction
+func (t *LoggingTransport) logReproductions(ctx context.Context, elog *exchangeLogger, reqInfo *requestInfo, methodAttr, urlAttr slog.Attr) {
+	for _, format := range t.reproduceFormats {
+		reproduction, err := reqInfo.reproduce(format)
+		if err != nil {
+			reproduction = err.Error()
+		}
+		elog.Log(ctx, LevelTrace, "request reproduction", methodAttr, urlAttr, slog.String("format", string(format)), slog.String("reproduction", reproduction))
+	}
+}
+
+// capturedResponseBody returns the redacted response body read by the caller so far with its encoding attributes,
+// see decodeForLog
+func (t *LoggingTransport) capturedResponseBody(reqInfo *requestInfo) ([]byte, bool, []slog.Attr, bool) {
+	bl := reqInfo.responseCapture
+	if bl == nil {
+		return nil, false, nil, false
+	}
+	raw, truncated, read := bl.captured()
+	body, truncated, encodingAttrs, ok := t.decodeCapturedBody(reqInfo.ResponseHeaders, raw, truncated, read)
+	if !ok {
+		return nil, false, nil, false
+	}
+	return t.redactor.RedactBody(reqInfo.ResponseHeaders.Get("Content-Type"), body), truncated, encodingAttrs, true
+}
+
+// decodeCapturedBody decodes a captured body sent with a Content-Encoding, see decodeForLog.
+// ok is false when the body has no Content-Type and the sniffed one should not be logged.
+func (t *LoggingTransport) decodeCapturedBody(header http.Header, raw []byte, truncated bool, compressedBytes int64) ([]byte, bool, []slog.Attr, bool) {
+	body, truncated, attrs := decodeForLog(header.Get("Content-Encoding"), raw, truncated, compressedBytes, t.maxBodyBytes)
+	if body != nil && header.Get("Content-Type") == "" && !loggableContentType(http.DetectContentType(body), t.bodyContentTypes) {
+		return nil, false, nil, false
+	}
+	return body, truncated, attrs, true
+}
+
 // requestInfo keeps track of information about a request/response combination
 type requestInfo struct {
-	RequestHeaders http.Header
-	RequestMethod  string
-	RequestURL     string
-
-	ResponseStatus  string
-	ResponseHeaders http.Header
-	ResponseErr     error
-
-	muTrace          sync.Mutex // Protect trace fields
-	DNSLookup        time.Duration
-	Dialing          time.Duration
-	GetConnection    time.Duration
-	TLSHandshake     time.Duration
-	ServerProcessing time.Duration
-	ConnectionReused bool
-
-	Duration time.Duration
+	RequestHeaders       http.Header
+	RequestMethod        string
+	RequestURL           string
+	RequestProto         string
+	RequestContentLength int64
+	RequestBody          []byte // set under muTrace once the transport sent the body, see captureRequestBody
+	RequestBodyTruncated bool
+	RequestBodyEncoding  []slog.Attr // the Content-Encoding and the sizes of an encoded RequestBody, see decodeForLog
+
+	ResponseStatus        string
+	ResponseStatusCode    int
+	ResponseProto         string
+	ResponseContentLength int64
+	ResponseHeaders       http.Header
+	ResponseErr           error
+	ErrorType             string // the classified ResponseErr, see classifyError
+
+	StartTime time.Time
+	traced    bool // trace fields are collected
+
+	requestURL      *url.URL
+	redactor        Redactor
+	responseCapture *bodyLogger // set when the response body is captured for logging
+	transferTracked bool        // the response body is wrapped by trackTransfer
+
+	muTrace           sync.Mutex    // Protect trace fields
+	QueueWait         time.Duration // waiting for LimitTransport
+	CacheStatus       string        // set by CacheTransport, see CacheStatusHit
+	DNSLookup         time.Duration // the last lookup
+	Dialing           time.Duration // the successful dial, or the first failed one
+	DNSAttempts       []dnsAttempt
+	DialAttempts      []dialAttempt
+	Informational     []informationalResponse
+	Waited100Continue bool
+	GetConnection     time.Duration
+	TLSHandshake      time.Duration
+	SendRequest       time.Duration // from the connection to the request written, with its body
+	ServerProcessing  time.Duration
+	ConnectionReused  bool
+	ClosedEarly       bool // the response body was closed before EOF
+	TLSState          *tls.ConnectionState
+	TLSErr            error
+	BytesRead         int64         // set once the response body is read or closed
+	TimeToLastByte    time.Duration // set once the response body is read or closed
+
+	Duration time.Duration // time to the response headers
 }
 
-func newRequestInfo(r *http.Request) *requestInfo {
+func newRequestInfo(r *http.Request, redactor Redactor) *requestInfo {
 	return &requestInfo{
-		RequestURL:     r.URL.String(),
-		RequestMethod:  r.Method,
-		RequestHeaders: r.Header,
+		requestURL:           r.URL,
+		redactor:             redactor,
+		RequestURL:           r.URL.String(),
+		RequestMethod:        r.Method,
+		RequestHeaders:       r.Header,
+		RequestProto:         r.Proto,
+		RequestContentLength: r.ContentLength,
 	}
 }
 
+type requestInfoKey struct{}
+
+// requestInfoFromContext returns the requestInfo of the LoggingTransport which sends the request,
+// wrapped RoundTrippers use it to add their own timing phases
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	reqInfo, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return reqInfo
+}
+
 // complete adds information about the response to the requestInfo
 func (r *requestInfo) complete(response *http.Response, err error) {
 	if err != nil {
@@ -217,65 +451,90 @@ func (r *requestInfo) complete(response *http.Response, err error) {
 		return
 	}
 	r.ResponseStatus = response.Status
+	r.ResponseStatusCode = response.StatusCode
+	r.ResponseProto = response.Proto
+	r.ResponseContentLength = response.ContentLength
 	r.ResponseHeaders = response.Header
 }
 
-// toCurl returns a string that can be run as a command in a terminal (minus the body)
-func (r *requestInfo) toCurl() string {
-	headers := ""
-	for key, values := range r.RequestHeaders {
-		for _, value := range values {
-			value = maskValue(key, value)
-			headers += fmt.Sprintf(` -H %q`, fmt.Sprintf("%s: %s", key, value))
-		}
-	}
+// redactedURL returns the request URL which is safe to log
+func (r *requestInfo) redactedURL() string {
+	return r.redactor.RedactURL(r.requestURL)
+}
+
+const LevelTrace = slog.Level(-8)
 
-	return fmt.Sprintf("curl -v -X%s %s '%s'", r.RequestMethod, headers, r.RequestURL)
+var LevelNames = map[slog.Leveler]string{
+	LevelTrace: "TRACE",
 }
 
-var knownAuthTypes = map[string]bool{
-	"bearer":    true,
-	"basic":     true,
-	"negotiate": true,
+func main() {
+	os.Exit(run())
 }
 
-// maskValue masks credential content from authorization headers
-// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Authorization
-func maskValue(key string, value string) string {
-	if !strings.EqualFold(key, "Authorization") {
-		return value
+// run runs the CLI and returns the exit code, the deferred calls such as saving the cassette run before exiting
+func run() int {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] URL\n       %s -proxy ADDR [-upstream URL] [flags]\n\n", os.Args[0], os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Sends the request and shows the time spent in each phase,\nor runs a proxy logging every exchange it forwards.\n\n")
+		flag.PrintDefaults()
 	}
-	if len(value) == 0 {
-		return ""
+
+	var opts cliOptions
+	flag.StringVar(&opts.method, "X", "", "request method, GET or POST with -d by default")
+	flag.Var(&opts.headers, "H", "request header, e.g. -H 'Accept: application/json', can be repeated")
+	flag.StringVar(&opts.data, "d", "", "request body, @file reads it from the file and @- from stdin")
+	insecure := flag.Bool("k", false, "skip the verification of the server certificate")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout of each request")
+	flag.IntVar(&opts.repeat, "n", 1, "number of times the request is sent, repeated requests reuse the connection")
+	flag.BoolVar(&opts.json, "json", false, "print the timing as JSON, including the reproduction of -reproduce")
+	curl := flag.Bool("curl", false, "print the redacted request as a curl command, same as -reproduce curl")
+	reproduce := flag.String("reproduce", "", "print the redacted request in the format: curl, httpie, go or http")
+	flag.StringVar(&opts.output, "o", "", "write the response body to the file, - for stdout")
+	verbose := flag.Bool("v", false, "log the exchange at the trace level to stderr")
+	bodyBytes := flag.Int64("log-body", 0, "log request and response bodies up to the given number of bytes")
+	proxyAddr := flag.String("proxy", "", "run a logging proxy listening on the address, e.g. localhost:8080")
+	upstream := flag.String("upstream", "", "with -proxy, forward every request to the upstream URL instead of being a forward proxy")
+	h2c := flag.Bool("h2c", false, "speak HTTP/2 without TLS to the upstream")
+	cassettePath := flag.String("cassette", "", "cassette file used to record or replay the requests")
+	cassetteMode := flag.String("mode", "replay", "cassette mode: record, replay or passthrough")
+	flag.Parse()
+
+	if (*proxyAddr == "" && flag.NArg() != 1) || (*proxyAddr != "" && flag.NArg() != 0) {
+		flag.Usage()
+		return 2
 	}
-	var authType string
-	if i := strings.Index(value, " "); i > 0 {
-		authType = value[0:i]
-	} else {
-		authType = value
+	opts.url = flag.Arg(0)
+	if opts.method == "" {
+		opts.method = http.MethodGet
+		if opts.data != "" {
+			opts.method = http.MethodPost
+		}
 	}
-	if !knownAuthTypes[strings.ToLower(authType)] {
-		return "<masked>"
+	if *curl && *reproduce == "" {
+		*reproduce = string(FormatCurl)
 	}
-	if len(value) > len(authType)+1 {
-		value = authType + " <masked>"
-	} else {
-		value = authType
+	if *reproduce != "" {
+		format, err := ParseReproduceFormat(*reproduce)
+		if err != nil {
+			fmt.Fprintln(flag.CommandLine.Output(), err)
+			return 2
+		}
+		opts.reproduce = format
 	}
-	return value
-}
-
-const LevelTrace = slog.Level(-8)
+	opts.repeat = max(opts.repeat, 1)
+	opts.color = !opts.json && colorEnabled(os.Stdout)
 
-var LevelNames = map[slog.Leveler]string{
-	LevelTrace: "TRACE",
-}
-
-func main() {
 	w := os.Stderr
-	opts := &slog.HandlerOptions{
-		// Level: slog.LevelDebug,
-		Level: LevelTrace,
+	level := slog.LevelWarn
+	if *proxyAddr != "" {
+		level = slog.LevelInfo
+	}
+	if *verbose {
+		level = LevelTrace
+	}
+	handlerOpts := &slog.HandlerOptions{
+		Level: level,
 		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
 			if a.Key == slog.LevelKey {
 				level := a.Value.Any().(slog.Level)
@@ -290,33 +549,64 @@ func main() {
 			return a
 		},
 	}
-	// logger := slog.New(slog.NewJSONHandler(w, opts))
-	logger := slog.New(slog.NewTextHandler(w, opts))
+	logger := slog.New(slog.NewTextHandler(w, handlerOpts))
 	slog.SetDefault(logger)
 
 	ctx := context.Background()
 
-	client := http.Client{Transport: NewLoggingTransport(WithLogger(logger), WithDetailedTiming(LevelTrace))}
-	req, err := http.NewRequestWithContext(ctx, "GET", "https://httpbin.org/get", nil)
-	if err != nil {
-		slog.ErrorContext(ctx, "Error creating request", slog.Any("error", err))
-		return
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if *h2c {
+		transport = NewH2CTransport()
+	}
+	if *insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	var rt http.RoundTripper = transport
+	if *cassettePath != "" {
+		mode, err := ParseReplayMode(*cassetteMode)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error parsing cassette mode", slog.Any("error", err))
+			return 2
+		}
+		replay, err := NewReplayTransport(*cassettePath, mode, WithReplayRoundTripper(transport))
+		if err != nil {
+			slog.ErrorContext(ctx, "Error loading cassette", slog.Any("error", err))
+			return 1
+		}
+		defer func() {
+			if err := replay.Close(); err != nil {
+				slog.ErrorContext(ctx, "Error saving cassette", slog.Any("error", err))
+			}
+		}()
+		rt = replay
 	}
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Authorization", "Bearer: XXX")
 
-	resp, err := client.Do(req)
-	resp, err = client.Do(req)
-	if err != nil {
-		slog.ErrorContext(ctx, "Error creating request", slog.Any("error", err))
-		return
+	options := []Option{WithLogger(logger), WithDetailedTiming(LevelTrace), WithRoundTripper(rt), WithReproduction()}
+	bodyLimit := *bodyBytes
+	if opts.reproduce != "" && bodyLimit == 0 {
+		// the reproduction only has the body when it's captured
+		bodyLimit = 1 << 20
+	}
+	if bodyLimit > 0 {
+		options = append(options, WithBodyLogging(bodyLimit))
 	}
+	loggingTransport := NewLoggingTransport(options...)
 
-	bytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		slog.ErrorContext(ctx, "Error reading body", slog.Any("error", err))
-		return
+	if *proxyAddr != "" {
+		if err := runProxy(ctx, logger, loggingTransport, *proxyAddr, *upstream); err != nil {
+			slog.ErrorContext(ctx, "Proxy failed", slog.Any("error", err))
+			return 1
+		}
+		return 0
 	}
 
-	fmt.Printf("body: %s\n", string(bytes))
+	client := &http.Client{
+		Transport: loggingTransport,
+		Timeout:   *timeout,
+	}
+	if err := runCLI(ctx, client, opts, os.Stdout); err != nil {
+		slog.ErrorContext(ctx, "Request failed", slog.Any("error", err))
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// durationBuckets are the bucket boundaries advised by the HTTP client semantic conventions
+// See https://opentelemetry.io/docs/specs/semconv/http/http-metrics/#metric-httpclientrequestduration
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10}
+
+// transportMetrics records the phases of the detailed timing as histograms
+type transportMetrics struct {
+	requestDuration  metric.Float64Histogram
+	queueWait        metric.Float64Histogram
+	dnsLookup        metric.Float64Histogram
+	dial             metric.Float64Histogram
+	tlsHandshake     metric.Float64Histogram
+	getConnection    metric.Float64Histogram
+	serverProcessing metric.Float64Histogram
+}
+
+// WithMeterProvider records the duration of the request and of every phase measured by the detailed timing
+// as histograms created by the given metric.MeterProvider
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(t *LoggingTransport) {
+		m, err := newTransportMetrics(mp)
+		if err != nil {
+			otel.Handle(err)
+			return
+		}
+		t.metrics = m
+	}
+}
+
+func newTransportMetrics(mp metric.MeterProvider) (*transportMetrics, error) {
+	meter := mp.Meter("http-log")
+
+	histogram := func(name, description string) (metric.Float64Histogram, error) {
+		return meter.Float64Histogram(name,
+			metric.WithDescription(description),
+			metric.WithUnit("s"),
+			metric.WithExplicitBucketBoundaries(durationBuckets...),
+		)
+	}
+
+	var m transportMetrics
+	var err error
+	if m.requestDuration, err = histogram("http.client.request.duration", "Duration of HTTP client requests."); err != nil {
+		return nil, err
+	}
+	if m.queueWait, err = histogram("http.client.queue_wait.duration", "Duration of waiting for the rate and concurrency limits of LimitTransport."); err != nil {
+		return nil, err
+	}
+	if m.dnsLookup, err = histogram("http.client.dns_lookup.duration", "Duration of DNS lookups made for HTTP client requests."); err != nil {
+		return nil, err
+	}
+	if m.dial, err = histogram("http.client.dial.duration", "Duration of establishing TCP connections for HTTP client requests."); err != nil {
+		return nil, err
+	}
+	if m.tlsHandshake, err = histogram("http.client.tls_handshake.duration", "Duration of TLS handshakes for HTTP client requests."); err != nil {
+		return nil, err
+	}
+	if m.getConnection, err = histogram("http.client.get_connection.duration", "Duration of obtaining a connection, new or from the pool, for HTTP client requests."); err != nil {
+		return nil, err
+	}
+	if m.serverProcessing, err = histogram("http.client.server_processing.duration", "Duration between writing the request and receiving the first response byte."); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// record adds the timings of the finished request to the histograms
+func (m *transportMetrics) record(ctx context.Context, reqInfo *requestInfo) {
+	reqInfo.muTrace.Lock()
+	defer reqInfo.muTrace.Unlock()
+
+	attrs := metric.WithAttributeSet(attribute.NewSet(metricAttributes(reqInfo)...))
+
+	m.requestDuration.Record(ctx, reqInfo.Duration.Seconds(), attrs)
+	recordPhase := func(h metric.Float64Histogram, d time.Duration) {
+		if d > 0 {
+			h.Record(ctx, d.Seconds(), attrs)
+		}
+	}
+	recordPhase(m.queueWait, reqInfo.QueueWait)
+	if !reqInfo.traced {
+		return
+	}
+	if !reqInfo.ConnectionReused {
+		recordPhase(m.dnsLookup, reqInfo.DNSLookup)
+		recordPhase(m.dial, reqInfo.Dialing)
+		recordPhase(m.tlsHandshake, reqInfo.TLSHandshake)
+	}
+	recordPhase(m.getConnection, reqInfo.GetConnection)
+	recordPhase(m.serverProcessing, reqInfo.ServerProcessing)
+}
+
+// metricAttributes follows the HTTP client semantic conventions
+// See https://opentelemetry.io/docs/specs/semconv/http/http-metrics/
+func metricAttributes(reqInfo *requestInfo) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", reqInfo.RequestMethod),
+		attribute.Bool("http.connection.reused", reqInfo.ConnectionReused),
+	}
+	if host, port := serverAddress(reqInfo.requestURL); host != "" {
+		attrs = append(attrs, attribute.String("server.address", host))
+		if p, err := strconv.Atoi(port); err == nil {
+			attrs = append(attrs, attribute.Int("server.port", p))
+		}
+	}
+	if reqInfo.ResponseErr != nil {
+		attrs = append(attrs, attribute.String("error.type", reqInfo.ErrorType))
+	} else {
+		attrs = append(attrs, attribute.String("http.response.status_class", statusClass(reqInfo.ResponseStatusCode)))
+	}
+	return attrs
+}
+
+// serverAddress splits the host of the URL, the port is inferred from the scheme if it's missing
+func serverAddress(u *url.URL) (string, string) {
+	if u == nil {
+		return "", ""
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Hostname()
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	return host, port
+}
+
+// statusClass returns the class of the status code, e.g. 2xx
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dxx", code/100)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// newMetricsClient returns a client logging nowhere whose histograms are read by the returned reader
+func newMetricsClient(t *testing.T) (*http.Client, *sdkmetric.ManualReader) {
+	t.Helper()
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	t.Cleanup(func() { _ = mp.Shutdown(context.Background()) })
+
+	transport := NewLoggingTransport(
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithRoundTripper(http.DefaultTransport.(*http.Transport).Clone()),
+		WithMeterProvider(mp),
+	)
+	return &http.Client{Transport: transport}, reader
+}
+
+// collectHistograms returns the data points of every histogram by name
+func collectHistograms(t *testing.T, reader *sdkmetric.ManualReader) map[string][]metricdata.HistogramDataPoint[float64] {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("collecting metrics: %v", err)
+	}
+	histograms := make(map[string][]metricdata.HistogramDataPoint[float64])
+	for _, sm := range rm.ScopeMetrics {
+		if sm.Scope.Name != "http-log" {
+			t.Errorf("scope = %q, want http-log", sm.Scope.Name)
+		}
+		for _, m := range sm.Metrics {
+			h, ok := m.Data.(metricdata.Histogram[float64])
+			if !ok {
+				t.Fatalf("%s is a %T, want a histogram", m.Name, m.Data)
+			}
+			if m.Unit != "s" {
+				t.Errorf("%s unit = %q, want s", m.Name, m.Unit)
+			}
+			histograms[m.Name] = h.DataPoints
+		}
+	}
+	return histograms
+}
+
+func totalCount(points []metricdata.HistogramDataPoint[float64]) uint64 {
+	var count uint64
+	for _, p := range points {
+		count += p.Count
+	}
+	return count
+}
+
+func wantAttr(t *testing.T, set attribute.Set, key string, want attribute.Value) {
+	t.Helper()
+	got, ok := set.Value(attribute.Key(key))
+	if !ok {
+		t.Errorf("attribute %s is missing from %v", key, set.ToSlice())
+		return
+	}
+	if got != want {
+		t.Errorf("attribute %s = %v, want %v", key, got.Emit(), want.Emit())
+	}
+}
+
+func TestMetricsRecordsPhases(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+
+	client, reader := newMetricsClient(t)
+	// the second request reuses the connection of the first one
+	for range 2 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	histograms := collectHistograms(t, reader)
+
+	duration := histograms["http.client.request.duration"]
+	if got := totalCount(duration); got != 2 {
+		t.Fatalf("http.client.request.duration count = %d, want 2", got)
+	}
+	if len(duration) != 2 {
+		t.Fatalf("http.client.request.duration has %d data points, want one for a new and one for a reused connection", len(duration))
+	}
+	for _, p := range duration {
+		wantAttr(t, p.Attributes, "http.request.method", attribute.StringValue(http.MethodGet))
+		wantAttr(t, p.Attributes, "http.response.status_class", attribute.StringValue("2xx"))
+		wantAttr(t, p.Attributes, "server.address", attribute.StringValue(host))
+		wantAttr(t, p.Attributes, "server.port", attribute.IntValue(port))
+		if _, ok := p.Attributes.Value("error.type"); ok {
+			t.Errorf("successful request has error.type: %v", p.Attributes.ToSlice())
+		}
+		if len(p.Bounds) != len(durationBuckets) {
+			t.Errorf("bucket boundaries = %v, want %v", p.Bounds, durationBuckets)
+		}
+	}
+
+	// connection phases are only recorded for the new connection
+	if got := totalCount(histograms["http.client.dial.duration"]); got != 1 {
+		t.Errorf("http.client.dial.duration count = %d, want 1", got)
+	}
+	for _, p := range histograms["http.client.dial.duration"] {
+		wantAttr(t, p.Attributes, "http.connection.reused", attribute.BoolValue(false))
+	}
+	if got := totalCount(histograms["http.client.server_processing.duration"]); got != 2 {
+		t.Errorf("http.client.server_processing.duration count = %d, want 2", got)
+	}
+	if got := totalCount(histograms["http.client.tls_handshake.duration"]); got != 0 {
+		t.Errorf("http.client.tls_handshake.duration count = %d, want 0 without TLS", got)
+	}
+}
+
+func TestMetricsRecordsErrorType(t *testing.T) {
+	// a listener which is closed right away gives a port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	client, reader := newMetricsClient(t)
+	if resp, err := client.Get("http://" + addr); err == nil {
+		resp.Body.Close()
+		t.Fatal("request to a closed port succeeded")
+	}
+
+	duration := collectHistograms(t, reader)["http.client.request.duration"]
+	if len(duration) != 1 || duration[0].Count != 1 {
+		t.Fatalf("http.client.request.duration = %+v, want a single data point", duration)
+	}
+	attrs := duration[0].Attributes
+	wantAttr(t, attrs, "error.type", attribute.StringValue(ErrorTypeConnectionRefused))
+	if _, ok := attrs.Value("http.response.status_class"); ok {
+		t.Errorf("failed request has a status class: %v", attrs.ToSlice())
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LevelOff is above every level, WithMinLevel(LevelOff) silences the transport
+const LevelOff = slog.Level(1 << 30)
+
+type optionsKey struct{}
+
+// WithOptions returns a context overriding the options of LoggingTransport for the requests sent with it,
+// e.g. WithOptions(ctx, WithMinLevel(LevelOff)) for health probes or WithOptions(ctx, WithBodyLogging(64<<10))
+// for a call which needs the full bodies. The options are applied on top of the ones given to NewLoggingTransport.
+// Options of a nested context are applied after the options of the outer ones, so the innermost context wins.
+// The options keeping state across requests are ignored in a context, the requests keep counting in the state
+// of the transport: WithLogPolicy, WithPoolStats, WithMeterProvider, WithHARRecorder and WithRecentRequests.
+func WithOptions(ctx context.Context, options ...Option) context.Context {
+	outer, _ := ctx.Value(optionsKey{}).([]Option)
+	merged := make([]Option, 0, len(outer)+len(options))
+	merged = append(merged, outer...)
+	merged = append(merged, options...)
+	return context.WithValue(ctx, optionsKey{}, merged)
+}
+
+// WithMinLevel drops the records of the exchange below the level
+func WithMinLevel(level slog.Leveler) Option {
+	return func(t *LoggingTransport) {
+		t.minLevel = level
+	}
+}
+
+// WithoutDetailedTiming turns off the detailed timing, it's meant to override WithDetailedTiming with WithOptions
+func WithoutDetailedTiming() Option {
+	return func(t *LoggingTransport) {
+		t.detailedTiming = false
+	}
+}
+
+// WithoutBodyLogging turns off the body logging, it's meant to override WithBodyLogging with WithOptions
+func WithoutBodyLogging() Option {
+	return func(t *LoggingTransport) {
+		t.bodyLogging = false
+	}
+}
+
+// forRequest returns the transport with the options of the request context applied, the transport itself is not modified
+func (t *LoggingTransport) forRequest(ctx context.Context) *LoggingTransport {
+	options, _ := ctx.Value(optionsKey{}).([]Option)
+	if len(options) == 0 {
+		return t
+	}
+	override := *t
+	for _, option := range options {
+		option(&override)
+	}
+	// the state shared by the requests is the transport's own, see WithOptions
+	override.logPolicy, override.dropped = t.logPolicy, t.dropped
+	override.pool = t.pool
+	override.metrics = t.metrics
+	override.har = t.har
+	override.recent = t.recent
+	override.summaries = t.summaries
+	return &override
+}
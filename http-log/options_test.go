@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithOptionsPerRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	transport := NewLoggingTransport(WithLogger(logger), WithRoundTripper(http.DefaultTransport.(*http.Transport).Clone()), WithPoolStats(time.Hour))
+	defer transport.Close()
+	client := &http.Client{Transport: transport}
+
+	get := func(options ...Option) {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(WithOptions(t.Context(), options...), http.MethodGet, srv.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, resp)
+	}
+
+	get(WithMinLevel(LevelOff))
+	if out := logs.String(); out != "" {
+		t.Errorf("WithMinLevel(LevelOff) logged:\n%s", out)
+	}
+
+	// the counters of the transport keep counting the requests sent with their own options
+	get(WithPoolStats(time.Millisecond), WithLogPolicy(LogPolicyFunc(func(*requestInfo) bool { return false }), time.Millisecond))
+	if !strings.Contains(logs.String(), "msg=response") {
+		t.Errorf("a LogPolicy given in the context dropped the records:\n%s", logs.String())
+	}
+	host := strings.TrimPrefix(srv.URL, "http://")
+	if stats := transport.PoolStats()[host]; stats.NewConns+stats.ReusedConns != 2 {
+		t.Errorf("pool stats = %+v, want the 2 requests counted", stats)
+	}
+}
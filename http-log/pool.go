@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WithPoolStats counts per host the new and reused connections, the idle time of reused connections
+// and the dials in flight, see LoggingTransport.PoolStats. The counters are logged every summaryInterval
+// in which a connection was dialed or used, and a last time by Close.
+func WithPoolStats(summaryInterval time.Duration) Option {
+	return func(t *LoggingTransport) {
+		t.pool = newPoolStats(summaryInterval)
+	}
+}
+
+// PoolStats are the connection pool counters of a host since the transport was created
+type PoolStats struct {
+	NewConns      int64         `json:"new_conns"`
+	ReusedConns   int64         `json:"reused_conns"`
+	IdleReuses    int64         `json:"idle_reuses"` // reused connections which were idle in the pool
+	TotalIdleTime time.Duration `json:"total_idle_time"`
+	MaxIdleTime   time.Duration `json:"max_idle_time"`
+	Dials         int64         `json:"dials"`
+	FailedDials   int64         `json:"failed_dials"`
+	DialsInFlight int64         `json:"dials_in_flight"`
+}
+
+// AvgIdleTime returns how long the reused connections waited in the pool on average
+func (s PoolStats) AvgIdleTime() time.Duration {
+	if s.IdleReuses == 0 {
+		return 0
+	}
+	return s.TotalIdleTime / time.Duration(s.IdleReuses)
+}
+
+// ReuseRatio returns the share of requests sent over a reused connection
+func (s PoolStats) ReuseRatio() float64 {
+	total := s.NewConns + s.ReusedConns
+	if total == 0 {
+		return 0
+	}
+	return float64(s.ReusedConns) / float64(total)
+}
+
+// PoolStats returns the counters of every host, it's empty without WithPoolStats
+func (t *LoggingTransport) PoolStats() map[string]PoolStats {
+	if t.pool == nil {
+		return map[string]PoolStats{}
+	}
+	return t.pool.snapshot()
+}
+
+// poolStats collects the counters from the trace of every request
+type poolStats struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	changed bool // since the previous summary
+	hosts   map[string]*PoolStats
+}
+
+func newPoolStats(interval time.Duration) *poolStats {
+	return &poolStats{
+		interval: interval,
+		hosts:    make(map[string]*PoolStats),
+	}
+}
+
+// host returns the counters of the host, it must be called with the lock held
+func (p *poolStats) host(host string) *PoolStats {
+	p.changed = true
+	s, ok := p.hosts[host]
+	if !ok {
+		s = &PoolStats{}
+		p.hosts[host] = s
+	}
+	return s
+}
+
+func (p *poolStats) dialStart(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.host(host)
+	s.Dials++
+	s.DialsInFlight++
+}
+
+func (p *poolStats) dialDone(host string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.host(host)
+	s.DialsInFlight--
+	if err != nil {
+		s.FailedDials++
+	}
+}
+
+func (p *poolStats) gotConn(host string, info httptrace.GotConnInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.host(host)
+	if !info.Reused {
+		s.NewConns++
+		return
+	}
+	s.ReusedConns++
+	if info.WasIdle {
+		s.IdleReuses++
+		s.TotalIdleTime += info.IdleTime
+		s.MaxIdleTime = max(s.MaxIdleTime, info.IdleTime)
+	}
+}
+
+func (p *poolStats) snapshot() map[string]PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make(map[string]PoolStats, len(p.hosts))
+	for host, s := range p.hosts {
+		stats[host] = *s
+	}
+	return stats
+}
+
+// logSummary logs the counters, unless no connection was dialed or used since the previous summary
+func (p *poolStats) logSummary(ctx context.Context, logger *slog.Logger) {
+	p.mu.Lock()
+	if !p.changed {
+		p.mu.Unlock()
+		return
+	}
+	p.changed = false
+	p.mu.Unlock()
+
+	stats := p.snapshot()
+	hosts := make([]string, 0, len(stats))
+	for host := range stats {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	perHost := make([]any, 0, len(hosts))
+	for _, host := range hosts {
+		s := stats[host]
+		perHost = append(perHost, slog.Group(host,
+			slog.Int64("new", s.NewConns),
+			slog.Int64("reused", s.ReusedConns),
+			slog.Float64("reuse_ratio", s.ReuseRatio()),
+			slog.Int64("AvgIdleTime_ms", s.AvgIdleTime().Milliseconds()),
+			slog.Int64("MaxIdleTime_ms", s.MaxIdleTime.Milliseconds()),
+			slog.Int64("dials", s.Dials),
+			slog.Int64("failed_dials", s.FailedDials),
+			slog.Int64("dials_in_flight", s.DialsInFlight),
+		))
+	}
+	logger.InfoContext(ctx, "connection pool summary", slog.Group("hosts", perHost...))
+}
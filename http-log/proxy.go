@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// Proxy is an http.Handler sending every request it receives through the RoundTripper, usually a LoggingTransport.
+// With an upstream it's a reverse proxy forwarding every request to it, otherwise it's a forward proxy
+// which sends requests to the host of their absolute URL and tunnels CONNECT requests.
+// The tunnels carry TLS, so only their target, duration and size are logged.
+type Proxy struct {
+	rt          http.RoundTripper
+	upstream    *url.URL
+	logger      *slog.Logger
+	dialTimeout time.Duration
+
+	reverseProxy *httputil.ReverseProxy
+}
+
+func NewProxy(rt http.RoundTripper, options ...ProxyOption) *Proxy {
+	p := &Proxy{
+		rt:          rt,
+		logger:      slog.Default(),
+		dialTimeout: 30 * time.Second,
+	}
+
+	for _, option := range options {
+		option(p)
+	}
+
+	p.reverseProxy = &httputil.ReverseProxy{
+		Rewrite:   p.rewrite,
+		Transport: p.rt,
+		// the failed exchange is already logged by the RoundTripper
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return p
+}
+
+type ProxyOption func(proxy *Proxy)
+
+// WithUpstream makes the proxy a reverse proxy forwarding every request to the upstream
+func WithUpstream(upstream *url.URL) ProxyOption {
+	return func(p *Proxy) {
+		p.upstream = upstream
+	}
+}
+
+func WithProxyLogger(logger *slog.Logger) ProxyOption {
+	return func(p *Proxy) {
+		p.logger = logger
+	}
+}
+
+// WithTunnelDialTimeout sets the timeout of connecting to the target of a CONNECT request
+func WithTunnelDialTimeout(timeout time.Duration) ProxyOption {
+	return func(p *Proxy) {
+		p.dialTimeout = timeout
+	}
+}
+
+// NewH2CTransport returns a transport speaking HTTP/2 without TLS (h2c) to the upstream
+func NewH2CTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	transport.Protocols = &protocols
+	return transport
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.upstream == nil {
+		if r.Method == http.MethodConnect {
+			p.tunnel(w, r)
+			return
+		}
+		if !r.URL.IsAbs() {
+			http.Error(w, "forward proxy requires an absolute URL", http.StatusBadRequest)
+			return
+		}
+	}
+	p.reverseProxy.ServeHTTP(w, r)
+}
+
+func (p *Proxy) rewrite(pr *httputil.ProxyRequest) {
+	// a forward proxy sends the request to the host of its absolute URL as it is
+	if p.upstream == nil {
+		return
+	}
+	pr.SetURL(p.upstream)
+	pr.SetXForwarded()
+}
+
+// tunnel connects the client with the target of the CONNECT request and copies the bytes both ways
+func (p *Proxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	rCtx := r.Context()
+	target := r.Host
+	targetAttr := slog.String("target", target)
+	start := time.Now()
+
+	dialer := net.Dialer{Timeout: p.dialTimeout}
+	upstream, err := dialer.DialContext(rCtx, "tcp", target)
+	if err != nil {
+		p.logger.ErrorContext(rCtx, "tunnel failed", targetAttr, slog.String("error.type", classifyError(rCtx, err)), slog.Any("error", err))
+		http.Error(w, "cannot connect to "+target, http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		p.logger.ErrorContext(rCtx, "tunnel failed", targetAttr, slog.String("error", "connection cannot be hijacked"))
+		http.Error(w, "CONNECT is not supported over "+r.Proto, http.StatusHTTPVersionNotSupported)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		p.logger.ErrorContext(rCtx, "tunnel failed", targetAttr, slog.Any("error", err))
+		return
+	}
+	defer client.Close()
+
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		p.logger.ErrorContext(rCtx, "tunnel failed", targetAttr, slog.Any("error", err))
+		return
+	}
+	p.logger.DebugContext(rCtx, "tunnel established", targetAttr, slog.Int64("Dial_ms", time.Since(start).Milliseconds()))
+
+	var sent, received int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// bytes the client sent right after the CONNECT request are already buffered
+		sent, _ = io.Copy(upstream, io.MultiReader(io.LimitReader(buffered, int64(buffered.Reader.Buffered())), client))
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(client, upstream)
+		closeWrite(client)
+	}()
+	wg.Wait()
+
+	p.logger.InfoContext(context.WithoutCancel(rCtx), "tunnel closed", targetAttr,
+		slog.Int64("bytes_sent", sent),
+		slog.Int64("bytes_received", received),
+		slog.Int64("Duration_ms", time.Since(start).Milliseconds()),
+	)
+}
+
+// closeWrite lets the other side of the tunnel know no more bytes will come, while still reading the response
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
+
+// runProxy serves the proxy on addr until the process is interrupted
+func runProxy(ctx context.Context, logger *slog.Logger, rt http.RoundTripper, addr, upstream string) error {
+	options := []ProxyOption{WithProxyLogger(logger)}
+	if upstream != "" {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return err
+		}
+		options = append(options, WithUpstream(u))
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	server := &http.Server{Addr: addr, Handler: NewProxy(rt, options...)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	logger.InfoContext(ctx, "proxy listening", slog.String("addr", addr), slog.String("upstream", upstream))
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
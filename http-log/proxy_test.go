@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer collects the records logged by the handlers of the proxy while the test reads them
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitFor waits until the log contains s, the proxy logs some records after the response is sent
+func (b *syncBuffer) waitFor(t *testing.T, s string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(b.String(), s) {
+		if time.Now().After(deadline) {
+			t.Fatalf("log does not contain %q:\n%s", s, b.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return b.String()
+}
+
+// newTestProxy serves a Proxy logging through a LoggingTransport into the returned buffer
+func newTestProxy(t *testing.T, options ...ProxyOption) (*httptest.Server, *syncBuffer) {
+	t.Helper()
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	transport := NewLoggingTransport(WithLogger(logger), WithRoundTripper(http.DefaultTransport.(*http.Transport).Clone()))
+	srv := httptest.NewServer(NewProxy(transport, append([]ProxyOption{WithProxyLogger(logger)}, options...)...))
+	t.Cleanup(srv.Close)
+	return srv, &logs
+}
+
+// echoServer answers with the path, the query and the forwarding headers it got
+func echoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "yes")
+		_, _ = io.WriteString(w, r.Method+" "+r.URL.RequestURI()+" host="+r.Header.Get("X-Forwarded-Host"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestProxyReverse(t *testing.T) {
+	upstream := echoServer(t)
+	upstreamURL, _ := url.Parse(upstream.URL)
+	proxy, logs := newTestProxy(t, WithUpstream(upstreamURL))
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	resp, err := http.Get(proxy.URL + "/items?page=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Upstream") != "yes" {
+		t.Errorf("response = %d %v, want the upstream response", resp.StatusCode, resp.Header)
+	}
+	if want := "GET /items?page=2 host=" + proxyURL.Host; body != want {
+		t.Errorf("upstream got %q, want %q", body, want)
+	}
+
+	out := logs.waitFor(t, `msg=response`)
+	if !strings.Contains(out, `url="`+upstream.URL+`/items?page=2"`) {
+		t.Errorf("the exchange with the upstream is not logged:\n%s", out)
+	}
+}
+
+func TestProxyReverseUpstreamDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamURL := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	l.Close()
+	proxy, logs := newTestProxy(t, WithUpstream(upstreamURL))
+
+	resp, err := http.Get(proxy.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+	logs.waitFor(t, "error.type="+ErrorTypeConnectionRefused)
+}
+
+func TestProxyForward(t *testing.T) {
+	target := echoServer(t)
+	proxy, logs := newTestProxy(t)
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Post(target.URL+"/submit", "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); body != "POST /submit host=" {
+		t.Errorf("target got %q, want the request as it was sent", body)
+	}
+	out := logs.waitFor(t, `msg=response`)
+	if !strings.Contains(out, "method=POST url="+target.URL+"/submit") {
+		t.Errorf("the forwarded exchange is not logged:\n%s", out)
+	}
+
+	// a request for the proxy itself has no absolute URL
+	resp, err = http.Get(proxy.URL + "/submit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status of a relative URL = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestProxyConnect(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "secret over TLS")
+	}))
+	defer target.Close()
+	proxy, logs := newTestProxy(t)
+	proxyURL, _ := url.Parse(proxy.URL)
+	targetURL, _ := url.Parse(target.URL)
+
+	transport := target.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get(target.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); body != "secret over TLS" {
+		t.Errorf("body = %q, want the response of the target", body)
+	}
+	// the tunnel is logged once the client closes its connection
+	transport.CloseIdleConnections()
+
+	out := logs.waitFor(t, "tunnel closed")
+	if !strings.Contains(out, "target="+targetURL.Host) {
+		t.Errorf("the tunnel target is not logged:\n%s", out)
+	}
+	if strings.Contains(out, "bytes_received=0 ") || strings.Contains(out, "bytes_sent=0 ") {
+		t.Errorf("the tunnel carried no bytes:\n%s", out)
+	}
+	if strings.Contains(out, "secret over TLS") {
+		t.Errorf("the content of the tunnel is logged:\n%s", out)
+	}
+}
+
+func TestProxyConnectTargetDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	proxy, logs := newTestProxy(t)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+	logs.waitFor(t, "tunnel failed")
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecentRequests keeps the last exchanges seen by LoggingTransport in a ring buffer.
+// It's an http.Handler showing them as HTML, or as JSON with ?format=json or Accept: application/json,
+// e.g. mux.Handle("/debug/outbound", recent).
+// The list can be filtered with the host, status (e.g. 404 or 5xx) and min_duration (e.g. 250ms) query parameters.
+type RecentRequests struct {
+	mu       sync.Mutex
+	requests []OutboundRequest
+	next     int
+	full     bool
+}
+
+// NewRecentRequests creates a buffer keeping the last size exchanges
+func NewRecentRequests(size int) *RecentRequests {
+	return &RecentRequests{requests: make([]OutboundRequest, max(size, 1))}
+}
+
+// WithRecentRequests records every exchange in the ring buffer
+func WithRecentRequests(recent *RecentRequests) Option {
+	return func(t *LoggingTransport) {
+		t.recent = recent
+	}
+}
+
+// OutboundRequest is the redacted snapshot of an exchange, see Reproduce to send it again
+type OutboundRequest struct {
+	StartTime       time.Time       `json:"start_time"`
+	Method          string          `json:"method"`
+	URL             string          `json:"url"`
+	Host            string          `json:"host"`
+	Status          string          `json:"status,omitempty"`
+	StatusCode      int             `json:"status_code,omitempty"`
+	Proto           string          `json:"proto,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	ErrorType       string          `json:"error_type,omitempty"`
+	CacheStatus     string          `json:"cache_status,omitempty"`
+	Duration        time.Duration   `json:"-"`
+	Timings         outboundTimings `json:"timings_ms"`
+	RequestHeaders  http.Header     `json:"request_headers,omitempty"`
+	ResponseHeaders http.Header     `json:"response_headers,omitempty"`
+	// RequestBody is only set when the body was captured, see WithBodyLogging
+	RequestBody          string `json:"request_body,omitempty"`
+	RequestBodyTruncated bool   `json:"request_body_truncated,omitempty"`
+	RequestContentLength int64  `json:"request_content_length,omitempty"`
+}
+
+// outboundTimings are in milliseconds, phases which were not measured are omitted
+type outboundTimings struct {
+	Duration         float64 `json:"duration"`
+	QueueWait        float64 `json:"queue_wait,omitempty"`
+	DNSLookup        float64 `json:"dns_lookup,omitempty"`
+	Dial             float64 `json:"dial,omitempty"`
+	TLSHandshake     float64 `json:"tls_handshake,omitempty"`
+	GetConnection    float64 `json:"get_connection,omitempty"`
+	ServerProcessing float64 `json:"server_processing,omitempty"`
+	ConnectionReused bool    `json:"connection_reused"`
+}
+
+func newOutboundRequest(reqInfo *requestInfo) OutboundRequest {
+	reqInfo.muTrace.Lock()
+	defer reqInfo.muTrace.Unlock()
+
+	req := OutboundRequest{
+		StartTime:            reqInfo.StartTime,
+		Method:               reqInfo.RequestMethod,
+		URL:                  reqInfo.redactedURL(),
+		Host:                 reqInfo.requestURL.Host,
+		Status:               reqInfo.ResponseStatus,
+		StatusCode:           reqInfo.ResponseStatusCode,
+		Proto:                reqInfo.ResponseProto,
+		ErrorType:            reqInfo.ErrorType,
+		CacheStatus:          reqInfo.CacheStatus,
+		Duration:             reqInfo.Duration,
+		RequestHeaders:       redactHeaders(reqInfo.redactor, reqInfo.RequestHeaders),
+		RequestBodyTruncated: reqInfo.RequestBodyTruncated,
+		RequestContentLength: reqInfo.RequestContentLength,
+		Timings: outboundTimings{
+			Duration:  harMillis(reqInfo.Duration),
+			QueueWait: harMillis(reqInfo.QueueWait),
+		},
+	}
+	if reqInfo.RequestBody != nil {
+		req.RequestBody = string(reqInfo.redactor.RedactBody(reqInfo.RequestHeaders.Get("Content-Type"), reqInfo.RequestBody))
+	}
+	if reqInfo.ResponseErr != nil {
+		req.Error = reqInfo.ResponseErr.Error()
+	} else {
+		req.ResponseHeaders = redactHeaders(reqInfo.redactor, reqInfo.ResponseHeaders)
+	}
+	if reqInfo.traced {
+		req.Timings.GetConnection = harMillis(reqInfo.GetConnection)
+		req.Timings.ServerProcessing = harMillis(reqInfo.ServerProcessing)
+		req.Timings.ConnectionReused = reqInfo.ConnectionReused
+		if !reqInfo.ConnectionReused {
+			req.Timings.DNSLookup = harMillis(reqInfo.DNSLookup)
+			req.Timings.Dial = harMillis(reqInfo.Dialing)
+			req.Timings.TLSHandshake = harMillis(reqInfo.TLSHandshake)
+		}
+	}
+	return req
+}
+
+// Record adds the exchange to the buffer, overwriting the oldest one when the buffer is full
+func (b *RecentRequests) Record(reqInfo *requestInfo) {
+	req := newOutboundRequest(reqInfo)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests[b.next] = req
+	b.next = (b.next + 1) % len(b.requests)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Snapshot returns the buffered exchanges, the newest first
+func (b *RecentRequests) Snapshot() []OutboundRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.next
+	if b.full {
+		n = len(b.requests)
+	}
+	requests := make([]OutboundRequest, 0, n)
+	for i := 1; i <= n; i++ {
+		requests = append(requests, b.requests[(b.next-i+len(b.requests))%len(b.requests)])
+	}
+	return requests
+}
+
+// outboundFilter selects the exchanges shown by the handler
+type outboundFilter struct {
+	Host        string
+	Status      string
+	MinDuration time.Duration
+}
+
+func parseOutboundFilter(r *http.Request) (outboundFilter, error) {
+	query := r.URL.Query()
+	filter := outboundFilter{Host: query.Get("host"), Status: strings.ToLower(query.Get("status"))}
+	if minDuration := query.Get("min_duration"); minDuration != "" {
+		d, err := time.ParseDuration(minDuration)
+		if err != nil {
+			return filter, err
+		}
+		filter.MinDuration = d
+	}
+	return filter, nil
+}
+
+func (f outboundFilter) matches(req OutboundRequest) bool {
+	if f.Host != "" && req.Host != f.Host {
+		return false
+	}
+	if req.Duration < f.MinDuration {
+		return false
+	}
+	switch {
+	case f.Status == "":
+	case f.Status == "error":
+		return req.Error != ""
+	case strings.HasSuffix(f.Status, "xx"):
+		return req.StatusCode != 0 && statusClass(req.StatusCode) == f.Status
+	default:
+		return strconv.Itoa(req.StatusCode) == f.Status
+	}
+	return true
+}
+
+func (b *RecentRequests) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseOutboundFilter(r)
+	if err != nil {
+		http.Error(w, "invalid min_duration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	requests := []OutboundRequest{}
+	for _, req := range b.Snapshot() {
+		if filter.matches(req) {
+			requests = append(requests, req)
+		}
+	}
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(requests)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = outboundTemplate.Execute(w, struct {
+		Filter   outboundFilter
+		Requests []OutboundRequest
+	}{filter, requests})
+}
+
+var outboundTemplate = template.Must(template.New("outbound").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Outbound requests</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+td.num { text-align: right; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Outbound requests</h1>
+<form>
+Host <input name="host" value="{{.Filter.Host}}">
+Status <input name="status" value="{{.Filter.Status}}" placeholder="404, 5xx or error" size="10">
+Min duration <input name="min_duration" value="{{if .Filter.MinDuration}}{{.Filter.MinDuration}}{{end}}" placeholder="250ms" size="10">
+<button>Filter</button>
+</form>
+<p>{{len .Requests}} requests</p>
+<table>
+<tr><th>Start</th><th>Method</th><th>URL</th><th>Status</th><th>Duration ms</th><th>Queue</th><th>DNS</th><th>Dial</th><th>TLS</th><th>Connection</th><th>Server</th><th>Reused</th></tr>
+{{range .Requests}}
+<tr>
+<td>{{.StartTime.Format "15:04:05.000"}}</td>
+<td>{{.Method}}</td>
+<td>{{.URL}}</td>
+{{if .Error}}<td class="error">{{.ErrorType}}: {{.Error}}</td>{{else}}<td>{{.Status}}{{if .CacheStatus}} ({{.CacheStatus}}){{end}}</td>{{end}}
+<td class="num">{{printf "%.1f" .Timings.Duration}}</td>
+<td class="num">{{printf "%.1f" .Timings.QueueWait}}</td>
+<td class="num">{{printf "%.1f" .Timings.DNSLookup}}</td>
+<td class="num">{{printf "%.1f" .Timings.Dial}}</td>
+<td class="num">{{printf "%.1f" .Timings.TLSHandshake}}</td>
+<td class="num">{{printf "%.1f" .Timings.GetConnection}}</td>
+<td class="num">{{printf "%.1f" .Timings.ServerProcessing}}</td>
+<td>{{.Timings.ConnectionReused}}</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// redactedValue replaces sensitive values in logs
+const redactedValue = "<masked>"
+
+// Redactor decides which parts of an exchange must not end up in logs, HAR files or curl commands
+type Redactor interface {
+	// RedactHeader returns the value of header key which is safe to log
+	RedactHeader(key, value string) string
+	// RedactURL returns the URL with sensitive query parameters masked
+	RedactURL(u *url.URL) string
+	// RedactBody returns the body of the given content type with sensitive fields masked
+	RedactBody(contentType string, body []byte) []byte
+}
+
+// RedactionPolicy is the default Redactor.
+// Headers are matched case-insensitively by name or by any of HeaderPatterns.
+// QueryParams are matched case-insensitively and apply to URLs and form bodies.
+// BodyFields are paths into JSON bodies: a single name like "password" matches the key at any depth,
+// a dotted path like "user.credentials.token" is matched from the root, "*" matches any key and arrays are traversed.
+// Names are matched case-insensitively.
+type RedactionPolicy struct {
+	Headers        []string
+	HeaderPatterns []*regexp.Regexp
+	QueryParams    []string
+	BodyFields     []string
+}
+
+// DefaultRedactor returns the policy used by LoggingTransport unless WithRedactor is given
+func DefaultRedactor() *RedactionPolicy {
+	return &RedactionPolicy{
+		Headers: []string{
+			"Authorization",
+			"Proxy-Authorization",
+			"Cookie",
+			"Set-Cookie",
+			"X-Api-Key",
+			"X-Auth-Token",
+		},
+		HeaderPatterns: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)(secret|token|password|api-?key)`),
+		},
+		QueryParams: []string{
+			"access_token",
+			"refresh_token",
+			"id_token",
+			"token",
+			"api_key",
+			"apikey",
+			"key",
+			"client_secret",
+			"password",
+			"secret",
+			"signature",
+			"sig",
+		},
+		BodyFields: []string{
+			"password",
+			"secret",
+			"token",
+			"access_token",
+			"refresh_token",
+			"id_token",
+			"client_secret",
+			"api_key",
+		},
+	}
+}
+
+// WithRedactor replaces the default redaction policy used for logs and curl output
+func WithRedactor(redactor Redactor) Option {
+	return func(t *LoggingTransport) {
+		t.redactor = redactor
+	}
+}
+
+func (p *RedactionPolicy) sensitiveHeader(key string) bool {
+	for _, h := range p.Headers {
+		if strings.EqualFold(h, key) {
+			return true
+		}
+	}
+	for _, re := range p.HeaderPatterns {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RedactionPolicy) sensitiveParam(key string) bool {
+	for _, q := range p.QueryParams {
+		if strings.EqualFold(q, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RedactionPolicy) RedactHeader(key, value string) string {
+	if !p.sensitiveHeader(key) || value == "" {
+		return value
+	}
+	switch http.CanonicalHeaderKey(key) {
+	case "Authorization", "Proxy-Authorization":
+		return maskCredentials(value)
+	case "Cookie":
+		return maskCookies(value, "; ")
+	case "Set-Cookie":
+		return maskSetCookie(value)
+	}
+	return redactedValue
+}
+
+func (p *RedactionPolicy) RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	if u.RawQuery == "" && u.User == nil {
+		return u.String()
+	}
+	redacted := *u
+	if redacted.User != nil {
+		if _, ok := redacted.User.Password(); ok {
+			redacted.User = url.UserPassword(redacted.User.Username(), redactedValue)
+		}
+	}
+	redacted.RawQuery = p.redactQuery(u.RawQuery)
+	return redacted.String()
+}
+
+// redactQuery masks sensitive parameters keeping the order and encoding of the rest of the query
+func (p *RedactionPolicy) redactQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	parts := strings.Split(rawQuery, "&")
+	for i, part := range parts {
+		key, _, found := strings.Cut(part, "=")
+		if !found {
+			continue
+		}
+		if name, err := url.QueryUnescape(key); err == nil && p.sensitiveParam(name) {
+			parts[i] = key + "=" + redactedValue
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func (p *RedactionPolicy) RedactBody(contentType string, body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		return []byte(p.redactQuery(string(body)))
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") || (mediaType == "" && json.Valid(body)):
+		return p.redactJSON(body)
+	}
+	return body
+}
+
+// redactJSON masks the configured fields of a JSON document.
+// A body which can't be parsed, e.g. because it was truncated, is masked field by field with a regular expression.
+func (p *RedactionPolicy) redactJSON(body []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return p.redactJSONFallback(body)
+	}
+	for _, field := range p.BodyFields {
+		path := strings.Split(strings.TrimPrefix(field, "$."), ".")
+		if len(path) == 1 {
+			redactJSONKey(doc, path[0])
+		} else {
+			redactJSONPath(doc, path)
+		}
+	}
+	var redacted bytes.Buffer
+	enc := json.NewEncoder(&redacted)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return p.redactJSONFallback(body)
+	}
+	return bytes.TrimSuffix(redacted.Bytes(), []byte("\n"))
+}
+
+// redactJSONFallback masks string and number values of every configured field name, matched case-insensitively
+// like redactJSONKey
+func (p *RedactionPolicy) redactJSONFallback(body []byte) []byte {
+	re := jsonFallbackPattern(p.BodyFields)
+	if re == nil {
+		return body
+	}
+	return re.ReplaceAll(body, []byte(`${1}"`+redactedValue+`"`))
+}
+
+// jsonFallbackPatterns caches the pattern of every list of body fields, the fields of a policy may be changed after use
+var jsonFallbackPatterns sync.Map
+
+// jsonFallbackPattern returns a single pattern matching the values of the last name of every field,
+// it's nil when there is no name to match
+func jsonFallbackPattern(fields []string) *regexp.Regexp {
+	cacheKey := strings.Join(fields, "\x00")
+	if re, ok := jsonFallbackPatterns.Load(cacheKey); ok {
+		return re.(*regexp.Regexp)
+	}
+
+	var names []string
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		if name := path[len(path)-1]; name != "*" {
+			names = append(names, regexp.QuoteMeta(name))
+		}
+	}
+	var re *regexp.Regexp
+	if len(names) > 0 {
+		re = regexp.MustCompile(`(?i)("(?:` + strings.Join(names, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[-0-9.eE+]+)`)
+	}
+	jsonFallbackPatterns.Store(cacheKey, re)
+	return re
+}
+
+// redactJSONKey masks the value of key at any depth of the document
+func redactJSONKey(node any, key string) {
+	switch n := node.(type) {
+	case map[string]any:
+		for k, v := range n {
+			if strings.EqualFold(k, key) {
+				n[k] = redactedValue
+				continue
+			}
+			redactJSONKey(v, key)
+		}
+	case []any:
+		for _, v := range n {
+			redactJSONKey(v, key)
+		}
+	}
+}
+
+// redactJSONPath masks the value found at path, keys are matched case-insensitively and arrays on the way are traversed
+func redactJSONPath(node any, path []string) {
+	switch n := node.(type) {
+	case map[string]any:
+		for k, v := range n {
+			if path[0] != "*" && !strings.EqualFold(path[0], k) {
+				continue
+			}
+			if len(path) == 1 {
+				n[k] = redactedValue
+			} else {
+				redactJSONPath(v, path[1:])
+			}
+		}
+	case []any:
+		for _, v := range n {
+			redactJSONPath(v, path)
+		}
+	}
+}
+
+var knownAuthTypes = map[string]bool{
+	"bearer":    true,
+	"basic":     true,
+	"negotiate": true,
+}
+
+// maskCredentials masks credential content from authorization headers keeping a known authentication scheme
+// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Authorization
+func maskCredentials(value string) string {
+	var authType string
+	if i := strings.Index(value, " "); i > 0 {
+		authType = value[0:i]
+	} else {
+		authType = value
+	}
+	if !knownAuthTypes[strings.ToLower(authType)] {
+		return redactedValue
+	}
+	if len(value) > len(authType)+1 {
+		value = authType + " " + redactedValue
+	} else {
+		value = authType
+	}
+	return value
+}
+
+// maskCookies keeps the cookie names and masks their values
+func maskCookies(value, sep string) string {
+	cookies := strings.Split(value, ";")
+	for i, cookie := range cookies {
+		name, _, found := strings.Cut(strings.TrimSpace(cookie), "=")
+		if found {
+			cookies[i] = name + "=" + redactedValue
+		} else {
+			cookies[i] = strings.TrimSpace(cookie)
+		}
+	}
+	return strings.Join(cookies, sep)
+}
+
+// maskSetCookie masks the cookie value keeping its attributes like Path or Expires
+func maskSetCookie(value string) string {
+	cookie, attributes, found := strings.Cut(value, ";")
+	masked := maskCookies(cookie, "; ")
+	if found {
+		masked += ";" + attributes
+	}
+	return masked
+}
+
+// redactHeaders returns a copy of the headers which is safe to log
+func redactHeaders(redactor Redactor, header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for key, values := range header {
+		for _, value := range values {
+			redacted[key] = append(redacted[key], redactor.RedactHeader(key, value))
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ReplayMode selects what ReplayTransport does with a request
+type ReplayMode int
+
+const (
+	// ModeReplay serves responses from the cassette and fails on requests which were not recorded
+	ModeReplay ReplayMode = iota
+	// ModeRecord sends requests with the wrapped RoundTripper and saves the exchanges to the cassette
+	ModeRecord
+	// ModePassthrough sends requests with the wrapped RoundTripper without touching the cassette
+	ModePassthrough
+)
+
+// ParseReplayMode converts the name of the mode as used in flags, e.g. "record"
+func ParseReplayMode(mode string) (ReplayMode, error) {
+	switch strings.ToLower(mode) {
+	case "replay":
+		return ModeReplay, nil
+	case "record":
+		return ModeRecord, nil
+	case "passthrough":
+		return ModePassthrough, nil
+	}
+	return 0, fmt.Errorf("unknown replay mode %q", mode)
+}
+
+// ErrNoInteraction is returned in replay mode when no recorded interaction matches the request
+var ErrNoInteraction = errors.New("no recorded interaction matches the request")
+
+// MatchRules configure which parts of the request have to be equal to the recorded one
+type MatchRules struct {
+	Method  bool
+	URL     bool
+	Headers []string
+	Body    bool
+}
+
+// ReplayTransport records exchanges to a JSON cassette file and replays them, so code using LoggingTransport
+// can be tested without network. Recorded exchanges are redacted before they are saved.
+type ReplayTransport struct {
+	rt       http.RoundTripper
+	mode     ReplayMode
+	path     string
+	redactor Redactor
+	match    MatchRules
+
+	mu           sync.Mutex
+	interactions []interaction
+	used         []bool
+}
+
+// NewReplayTransport creates a ReplayTransport using the cassette at path, in replay mode the cassette is loaded
+func NewReplayTransport(path string, mode ReplayMode, options ...ReplayOption) (*ReplayTransport, error) {
+	t := &ReplayTransport{
+		rt:       http.DefaultTransport,
+		mode:     mode,
+		path:     path,
+		redactor: DefaultRedactor(),
+		match:    MatchRules{Method: true, URL: true},
+	}
+
+	for _, option := range options {
+		option(t)
+	}
+
+	if mode == ModeReplay {
+		if err := t.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+type ReplayOption func(transport *ReplayTransport)
+
+func WithReplayRoundTripper(rt http.RoundTripper) ReplayOption {
+	return func(t *ReplayTransport) {
+		t.rt = rt
+	}
+}
+
+// WithReplayRedactor sets the redaction policy applied to recorded exchanges
+func WithReplayRedactor(redactor Redactor) ReplayOption {
+	return func(t *ReplayTransport) {
+		t.redactor = redactor
+	}
+}
+
+// WithMatchRules replaces the default rules which match the method and the URL
+func WithMatchRules(rules MatchRules) ReplayOption {
+	return func(t *ReplayTransport) {
+		t.match = rules
+	}
+}
+
+// cassette is the file format of the recorded exchanges
+type cassette struct {
+	Interactions []interaction `json:"interactions"`
+}
+
+type interaction struct {
+	RecordedAt time.Time        `json:"recorded_at"`
+	Request    recordedRequest  `json:"request"`
+	Response   recordedResponse `json:"response"`
+}
+
+type recordedRequest struct {
+	Method  string       `json:"method"`
+	URL     string       `json:"url"`
+	Headers http.Header  `json:"headers,omitempty"`
+	Body    recordedBody `json:"body"`
+}
+
+type recordedResponse struct {
+	StatusCode int          `json:"status_code"`
+	Status     string       `json:"status"`
+	Headers    http.Header  `json:"headers,omitempty"`
+	Body       recordedBody `json:"body"`
+}
+
+// recordedBody keeps text bodies readable in the cassette, other bodies are base64 encoded
+type recordedBody struct {
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func newRecordedBody(body []byte) recordedBody {
+	if utf8.Valid(body) {
+		return recordedBody{Text: string(body)}
+	}
+	return recordedBody{Text: base64.StdEncoding.EncodeToString(body), Encoding: "base64"}
+}
+
+func (b recordedBody) bytes() []byte {
+	if b.Encoding == "base64" {
+		body, err := base64.StdEncoding.DecodeString(b.Text)
+		if err != nil {
+			return nil
+		}
+		return body
+	}
+	return []byte(b.Text)
+}
+
+func (t *ReplayTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	switch t.mode {
+	case ModeRecord:
+		return t.record(r)
+	case ModeReplay:
+		return t.replay(r)
+	}
+	return t.rt.RoundTrip(r)
+}
+
+// Close saves the cassette in record mode
+func (t *ReplayTransport) Close() error {
+	if t.mode != ModeRecord {
+		return nil
+	}
+	return t.Save()
+}
+
+// Save writes the recorded exchanges to the cassette file
+func (t *ReplayTransport) Save() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	data, err := json.MarshalIndent(cassette{Interactions: t.interactions}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(t.path, data, 0o644)
+}
+
+func (t *ReplayTransport) load() error {
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	var c cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		return fmt.Errorf("parsing cassette %s: %w", t.path, err)
+	}
+	t.interactions = c.Interactions
+	t.used = make([]bool, len(c.Interactions))
+	return nil
+}
+
+func (t *ReplayTransport) record(r *http.Request) (*http.Response, error) {
+	r, reqBody, err := readRequestBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.rt.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	rec := interaction{
+		RecordedAt: time.Now().UTC(),
+		Request:    t.recordRequest(r, reqBody),
+		Response: recordedResponse{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Headers:    redactHeaders(t.redactor, resp.Header),
+			Body:       newRecordedBody(t.redactor.RedactBody(resp.Header.Get("Content-Type"), respBody)),
+		},
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.interactions = append(t.interactions, rec)
+	t.used = append(t.used, false)
+
+	return resp, nil
+}
+
+func (t *ReplayTransport) replay(r *http.Request) (*http.Response, error) {
+	_, reqBody, err := readRequestBody(r)
+	if err != nil {
+		return nil, err
+	}
+	req := t.recordRequest(r, reqBody)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// the first unused interaction wins so repeated requests get the responses in the recorded order,
+	// once all of them were used the last matching one is served again
+	found := -1
+	for i, rec := range t.interactions {
+		if !t.matches(rec.Request, req) {
+			continue
+		}
+		found = i
+		if !t.used[i] {
+			break
+		}
+	}
+	if found < 0 {
+		return nil, fmt.Errorf("%w: %s %s", ErrNoInteraction, req.Method, req.URL)
+	}
+	t.used[found] = true
+
+	rec := t.interactions[found].Response
+	body := rec.Body.bytes()
+	return &http.Response{
+		Status:        rec.Status,
+		StatusCode:    rec.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.Headers.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}, nil
+}
+
+// recordRequest returns the redacted form of the request which is saved and matched
+func (t *ReplayTransport) recordRequest(r *http.Request, body []byte) recordedRequest {
+	return recordedRequest{
+		Method:  r.Method,
+		URL:     t.redactor.RedactURL(r.URL),
+		Headers: redactHeaders(t.redactor, r.Header),
+		Body:    newRecordedBody(t.redactor.RedactBody(r.Header.Get("Content-Type"), body)),
+	}
+}
+
+func (t *ReplayTransport) matches(recorded, req recordedRequest) bool {
+	if t.match.Method && recorded.Method != req.Method {
+		return false
+	}
+	if t.match.URL && recorded.URL != req.URL {
+		return false
+	}
+	for _, h := range t.match.Headers {
+		if strings.Join(recorded.Headers.Values(h), ",") != strings.Join(req.Headers.Values(h), ",") {
+			return false
+		}
+	}
+	if t.match.Body && recorded.Body != req.Body {
+		return false
+	}
+	return true
+}
+
+// readRequestBody reads the whole request body.
+// It returns a shallow copy of the request with the body replaced, so the request can still be sent.
+func readRequestBody(r *http.Request) (*http.Request, []byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return r, nil, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return r, nil, err
+	}
+	r = r.WithContext(r.Context())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return r, body, nil
+}
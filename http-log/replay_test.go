@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// failingTransport fails the test when a request reaches the network
+type failingTransport struct {
+	t *testing.T
+}
+
+func (f failingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	f.t.Errorf("unexpected network request %s %s", r.Method, r.URL)
+	return nil, errors.New("network is not allowed")
+}
+
+// discardLogger returns a logger for tests which only check the exchanges
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestReplayRecordThenReplay(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Set-Cookie", "session=secret")
+		_, _ = io.WriteString(w, r.Method+" "+r.URL.Path+" "+string(body)+" #"+strconv.Itoa(int(n)))
+	}))
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	recorder, err := NewReplayTransport(path, ModeRecord, WithReplayRoundTripper(http.DefaultTransport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: NewLoggingTransport(WithLogger(discardLogger()), WithRoundTripper(recorder))}
+	var recorded []string
+	for _, req := range []struct{ method, path, body string }{
+		{http.MethodGet, "/items", ""},
+		{http.MethodGet, "/items", ""},
+		{http.MethodPost, "/items", "name=x"},
+	} {
+		r, _ := http.NewRequest(req.method, srv.URL+req.path, strings.NewReader(req.body))
+		r.Header.Set("Authorization", "Bearer secret-token")
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorded = append(recorded, readBody(t, resp))
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the replay must not need the server
+	srv.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"secret-token", "session=secret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("cassette contains %q:\n%s", secret, data)
+		}
+	}
+
+	replayer, err := NewReplayTransport(path, ModeReplay, WithReplayRoundTripper(failingTransport{t}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &http.Client{Transport: NewLoggingTransport(WithLogger(discardLogger()), WithRoundTripper(replayer))}
+	replayed := func(method, body string) string {
+		t.Helper()
+		r, _ := http.NewRequest(method, srv.URL+"/items", strings.NewReader(body))
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return readBody(t, resp)
+	}
+
+	// repeated requests get the responses in the recorded order, then the last one again
+	for i, want := range []string{recorded[0], recorded[1], recorded[1]} {
+		if got := replayed(http.MethodGet, ""); got != want {
+			t.Errorf("GET %d = %q, want %q", i+1, got, want)
+		}
+	}
+	if got := replayed(http.MethodPost, "name=x"); got != recorded[2] {
+		t.Errorf("POST = %q, want %q", got, recorded[2])
+	}
+	if calls.Load() != 3 {
+		t.Errorf("server got %d requests, want the 3 recorded ones", calls.Load())
+	}
+}
+
+func TestReplayFromCassette(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	cassette := `{
+  "interactions": [
+    {
+      "recorded_at": "2024-01-02T03:04:05Z",
+      "request": {"method": "GET", "url": "https://api.example.test/users/1", "body": {}},
+      "response": {
+        "status_code": 200,
+        "status": "200 OK",
+        "headers": {"Content-Type": ["application/json"]},
+        "body": {"text": "{\"id\":1}"}
+      }
+    },
+    {
+      "recorded_at": "2024-01-02T03:04:06Z",
+      "request": {"method": "GET", "url": "https://api.example.test/logo", "body": {}},
+      "response": {
+        "status_code": 200,
+        "status": "200 OK",
+        "headers": {"Content-Type": ["image/png"]},
+        "body": {"text": "iVBORw==", "encoding": "base64"}
+      }
+    }
+  ]
+}`
+	if err := os.WriteFile(path, []byte(cassette), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer, err := NewReplayTransport(path, ModeReplay, WithReplayRoundTripper(failingTransport{t}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: replayer}
+
+	resp, err := client.Get("https://api.example.test/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("response = %d %v, want 200 with the recorded headers", resp.StatusCode, resp.Header)
+	}
+	if got := readBody(t, resp); got != `{"id":1}` {
+		t.Errorf("body = %q, want the recorded text", got)
+	}
+
+	resp, err = client.Get("https://api.example.test/logo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readBody(t, resp); got != "\x89PNG" {
+		t.Errorf("body = %q, want the decoded base64 body", got)
+	}
+}
+
+func TestReplayUnmatched(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	cassette := `{"interactions": [{
+  "request": {"method": "POST", "url": "https://api.example.test/items", "body": {"text": "a=1"}},
+  "response": {"status_code": 201, "status": "201 Created", "body": {"text": "created"}}
+}]}`
+	if err := os.WriteFile(path, []byte(cassette), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		rules       MatchRules
+		method, url string
+		body        string
+		wantMatch   bool
+	}{
+		{"same request", MatchRules{Method: true, URL: true}, http.MethodPost, "https://api.example.test/items", "a=1", true},
+		{"other method", MatchRules{Method: true, URL: true}, http.MethodPut, "https://api.example.test/items", "a=1", false},
+		{"other URL", MatchRules{Method: true, URL: true}, http.MethodPost, "https://api.example.test/items?page=2", "a=1", false},
+		{"other body ignored", MatchRules{Method: true, URL: true}, http.MethodPost, "https://api.example.test/items", "a=2", true},
+		{"other body matched", MatchRules{Method: true, URL: true, Body: true}, http.MethodPost, "https://api.example.test/items", "a=2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replayer, err := NewReplayTransport(path, ModeReplay, WithReplayRoundTripper(failingTransport{t}), WithMatchRules(tt.rules))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, _ := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			resp, err := replayer.RoundTrip(r)
+			if !tt.wantMatch {
+				if !errors.Is(err, ErrNoInteraction) {
+					t.Fatalf("error = %v, want ErrNoInteraction", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readBody(t, resp); resp.StatusCode != http.StatusCreated || got != "created" {
+				t.Errorf("response = %d %q, want the recorded 201", resp.StatusCode, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ReproduceFormat is the syntax of a copy-pasteable reproduction of a request, see OutboundRequest.Reproduce
+type ReproduceFormat string
+
+const (
+	// FormatCurl is a curl command sending the body with --data-binary, or --data-raw when it starts with @,
+	// a HEAD request is sent with --head
+	FormatCurl ReproduceFormat = "curl"
+	// FormatHTTPie is an HTTPie command sending the body with --raw
+	FormatHTTPie ReproduceFormat = "httpie"
+	// FormatGo is a Go snippet sending the request with http.NewRequest and http.DefaultClient
+	FormatGo ReproduceFormat = "go"
+	// FormatHTTPFile is a .http file as used by the REST client of editors
+	FormatHTTPFile ReproduceFormat = "http"
+)
+
+// ReproduceFormats lists the supported formats
+var ReproduceFormats = []ReproduceFormat{FormatCurl, FormatHTTPie, FormatGo, FormatHTTPFile}
+
+// ParseReproduceFormat returns the format of the given name
+func ParseReproduceFormat(name string) (ReproduceFormat, error) {
+	for _, format := range ReproduceFormats {
+		if strings.EqualFold(name, string(format)) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("unknown reproduction format %q", name)
+}
+
+// WithReproduction logs a redacted reproduction of every request at the trace level, in each of the formats (curl by default).
+// The body is only part of the reproduction when it is captured, see WithBodyLogging.
+func WithReproduction(formats ...ReproduceFormat) Option {
+	return func(t *LoggingTransport) {
+		if len(formats) == 0 {
+			formats = []ReproduceFormat{FormatCurl}
+		}
+		t.reproduceFormats = formats
+	}
+}
+
+// reproduction is the redacted request a reproduction is written from
+type reproduction struct {
+	method    string
+	url       string
+	headers   http.Header
+	body      []byte
+	truncated bool
+	// uncaptured is set when the request has a body which was not captured
+	uncaptured bool
+}
+
+// reproduction returns the redacted request
+func (r *requestInfo) reproduction() reproduction {
+	r.muTrace.Lock()
+	defer r.muTrace.Unlock()
+
+	rep := reproduction{
+		method:    r.RequestMethod,
+		url:       r.redactedURL(),
+		headers:   redactHeaders(r.redactor, r.RequestHeaders),
+		truncated: r.RequestBodyTruncated,
+	}
+	if r.RequestBody != nil {
+		rep.body = r.redactor.RedactBody(r.RequestHeaders.Get("Content-Type"), r.RequestBody)
+	} else {
+		rep.uncaptured = r.RequestContentLength != 0
+	}
+	return rep
+}
+
+// Reproduce returns the redacted request in the given format, so it can be sent again
+func (o OutboundRequest) Reproduce(format ReproduceFormat) (string, error) {
+	rep := reproduction{
+		method:     o.Method,
+		url:        o.URL,
+		headers:    o.RequestHeaders,
+		truncated:  o.RequestBodyTruncated,
+		uncaptured: o.RequestBody == "" && o.RequestContentLength != 0,
+	}
+	if o.RequestBody != "" {
+		rep.body = []byte(o.RequestBody)
+	}
+	return rep.format(format)
+}
+
+// reproduce returns the redacted request in the given format
+func (r *requestInfo) reproduce(format ReproduceFormat) (string, error) {
+	return r.reproduction().format(format)
+}
+
+func (rep reproduction) format(format ReproduceFormat) (string, error) {
+	switch format {
+	case FormatCurl:
+		return rep.curl(), nil
+	case FormatHTTPie:
+		return rep.httpie(), nil
+	case FormatGo:
+		return rep.goSnippet(), nil
+	case FormatHTTPFile:
+		return rep.httpFile(), nil
+	}
+	return "", fmt.Errorf("unknown reproduction format %q", format)
+}
+
+// note explains why the reproduction does not send the same body, it's empty when it does
+func (rep reproduction) note() string {
+	switch {
+	case rep.uncaptured:
+		return "the request body was not captured"
+	case rep.truncated:
+		return fmt.Sprintf("the request body was truncated to %d bytes", len(rep.body))
+	}
+	return ""
+}
+
+// headerLines returns the headers sorted by name.
+// Content-Length is left to the client, and the captured body was decoded so Content-Encoding no longer applies.
+func (rep reproduction) headerLines() [][2]string {
+	names := make([]string, 0, len(rep.headers))
+	for name := range rep.headers {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length":
+			continue
+		case "Content-Encoding":
+			if rep.body != nil {
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines [][2]string
+	for _, name := range names {
+		for _, value := range rep.headers[name] {
+			lines = append(lines, [2]string{name, value})
+		}
+	}
+	return lines
+}
+
+func (rep reproduction) curl() string {
+	var b strings.Builder
+	if note := rep.note(); note != "" {
+		fmt.Fprintf(&b, "# %s\n", note)
+	}
+	b.WriteString("curl")
+	switch {
+	case rep.method == http.MethodHead && rep.body == nil:
+		// with -X HEAD curl waits for a response body which never comes
+		b.WriteString(" --head")
+	case rep.method != http.MethodGet || rep.body != nil:
+		b.WriteString(" -X " + shellQuote(rep.method))
+	}
+	for _, h := range rep.headerLines() {
+		// curl removes a header given as "Name:", an empty value is sent with "Name;"
+		header := h[0] + ": " + h[1]
+		if h[1] == "" {
+			header = h[0] + ";"
+		}
+		b.WriteString(" \\\n  -H " + shellQuote(header))
+	}
+	if rep.body != nil {
+		// --data-binary reads the file named after a leading @, --data-raw sends it as it is
+		option := "--data-binary"
+		if bytes.HasPrefix(rep.body, []byte("@")) {
+			option = "--data-raw"
+		}
+		b.WriteString(" \\\n  " + option + " " + shellQuote(string(rep.body)))
+	}
+	b.WriteString(" \\\n  " + shellQuote(rep.url))
+	return b.String()
+}
+
+func (rep reproduction) httpie() string {
+	var b strings.Builder
+	if note := rep.note(); note != "" {
+		fmt.Fprintf(&b, "# %s\n", note)
+	}
+	b.WriteString("http")
+	if rep.body != nil {
+		b.WriteString(" --raw " + shellQuote(string(rep.body)))
+	}
+	b.WriteString(" " + shellQuote(rep.method) + " " + shellQuote(rep.url))
+	for _, h := range rep.headerLines() {
+		// HTTPie removes a header given as "Name:", an empty value is sent with "Name;"
+		item := h[0] + ":" + httpieEscape(h[1])
+		if h[1] == "" {
+			item = h[0] + ";"
+		}
+		b.WriteString(" \\\n  " + shellQuote(item))
+	}
+	return b.String()
+}
+
+func (rep reproduction) goSnippet() string {
+	var b strings.Builder
+	if note := rep.note(); note != "" {
+		fmt.Fprintf(&b, "// %s\n", note)
+	}
+	body := "nil"
+	if rep.body != nil {
+		body = "strings.NewReader(" + goString(string(rep.body)) + ")"
+	}
+	method := goString(rep.method)
+	if constant, ok := goMethodConstants[rep.method]; ok {
+		method = constant
+	}
+	fmt.Fprintf(&b, "req, err := http.NewRequest(%s, %s, %s)\n", method, strconv.Quote(rep.url), body)
+	b.WriteString("if err != nil {\n\tlog.Fatal(err)\n}\n")
+	for _, h := range rep.headerLines() {
+		if http.CanonicalHeaderKey(h[0]) == "Host" {
+			fmt.Fprintf(&b, "req.Host = %s\n", strconv.Quote(h[1]))
+			continue
+		}
+		fmt.Fprintf(&b, "req.Header.Add(%s, %s)\n", strconv.Quote(h[0]), strconv.Quote(h[1]))
+	}
+	b.WriteString("resp, err := http.DefaultClient.Do(req)\n")
+	b.WriteString("if err != nil {\n\tlog.Fatal(err)\n}\n")
+	b.WriteString("defer resp.Body.Close()")
+	return b.String()
+}
+
+var goMethodConstants = map[string]string{
+	http.MethodGet:     "http.MethodGet",
+	http.MethodHead:    "http.MethodHead",
+	http.MethodPost:    "http.MethodPost",
+	http.MethodPut:     "http.MethodPut",
+	http.MethodPatch:   "http.MethodPatch",
+	http.MethodDelete:  "http.MethodDelete",
+	http.MethodConnect: "http.MethodConnect",
+	http.MethodOptions: "http.MethodOptions",
+	http.MethodTrace:   "http.MethodTrace",
+}
+
+// goString returns a Go string literal, a raw string when it keeps a multi-line body readable
+func goString(s string) string {
+	if strings.Contains(s, "\n") && !strings.ContainsAny(s, "`\r") && utf8.ValidString(s) &&
+		strings.IndexFunc(s, func(r rune) bool { return r != '\n' && r != '\t' && !unicode.IsPrint(r) }) == -1 {
+		return "`" + s + "`"
+	}
+	return strconv.Quote(s)
+}
+
+func (rep reproduction) httpFile() string {
+	var b strings.Builder
+	if note := rep.note(); note != "" {
+		fmt.Fprintf(&b, "# %s\n", note)
+	}
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\n", rep.method, rep.url)
+	for _, h := range rep.headerLines() {
+		fmt.Fprintf(&b, "%s: %s\n", h[0], h[1])
+	}
+	if rep.body != nil {
+		b.WriteString("\n")
+		b.Write(rep.body)
+		if !strings.HasSuffix(string(rep.body), "\n") {
+			b.WriteString("\n")
+		}
+	}
+	b.WriteString("\n###")
+	return b.String()
+}
+
+// shellQuote quotes s as a single word for POSIX shells.
+// Printable strings are single quoted, which keeps newlines as they are, and strings with other control
+// characters or invalid UTF-8 use the $'...' quoting of bash and zsh with escapes.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_./:=@%+,", r)))
+	}) == -1 {
+		return s
+	}
+
+	if utf8.ValidString(s) && strings.IndexFunc(s, func(r rune) bool { return r != '\n' && r != '\t' && !unicode.IsPrint(r) }) == -1 {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+
+	var b strings.Builder
+	b.WriteString("$'")
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, `\x%02x`, s[i])
+		case r == '\\' || r == '\'':
+			b.WriteString(`\` + string(r))
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case !unicode.IsPrint(r):
+			// the UTF-8 bytes, bash only expands \U in a UTF-8 locale
+			for _, c := range []byte(s[i : i+size]) {
+				fmt.Fprintf(&b, `\x%02x`, c)
+			}
+		default:
+			b.WriteRune(r)
+		}
+		i += size
+	}
+	b.WriteString("'")
+	return b.String()
+}
+
+// httpieEscape escapes the backslashes of a header value, HTTPie reads them as escapes of its item separators
+func httpieEscape(value string) string {
+	return strings.ReplaceAll(value, `\`, `\\`)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// escapeCases are the strings every escaping function must keep intact
+var escapeCases = []struct {
+	name string
+	s    string
+}{
+	{"empty", ""},
+	{"plain", "https://example.test/a-b_c.d?x=1&y=2"},
+	{"space", "hello world"},
+	{"single quote", "it's"},
+	{"double quote", `say "hi"`},
+	{"backslash", `C:\path\n`},
+	{"dollar and backtick", "$HOME `id` $(id)"},
+	{"newline", "line 1\nline 2\n"},
+	{"carriage return", "a\r\nb"},
+	{"tab", "a\tb"},
+	{"control bytes", "a\x00b\x01c\x1b[0m\x7f"},
+	{"invalid UTF-8", "a\xff\xfeb"},
+	{"unicode", "héllo 世界"},
+	{"unicode control", "a\u2028b"},
+	{"leading at", "@/etc/passwd"},
+	{"leading dash", "-X"},
+}
+
+func TestShellQuote(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not installed")
+	}
+	for _, tt := range escapeCases {
+		if strings.Contains(tt.s, "\x00") {
+			// a shell word can't hold a NUL byte
+			continue
+		}
+		t.Run(tt.name, func(t *testing.T) {
+			quoted := shellQuote(tt.s)
+			out, err := exec.Command(bash, "-c", "printf %s "+quoted).Output()
+			if err != nil {
+				t.Fatalf("bash failed on %s: %v", quoted, err)
+			}
+			if string(out) != tt.s {
+				t.Errorf("shellQuote(%q) = %s, the shell reads %q", tt.s, quoted, out)
+			}
+		})
+	}
+}
+
+func TestShellQuoteForms(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"", "''"},
+		{"https://example.test/a", "https://example.test/a"},
+		{"it's", `'it'\''s'`},
+		{"a\nb", "'a\nb'"},
+		{"a\x00b", `$'a\x00b'`},
+		{"a\xffb", `$'a\xffb'`},
+		{"a'\r", `$'a\'\r'`},
+		{"a\u2028", `$'a\xe2\x80\xa8'`},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.s); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestGoString(t *testing.T) {
+	for _, tt := range escapeCases {
+		t.Run(tt.name, func(t *testing.T) {
+			literal := goString(tt.s)
+			got, err := strconv.Unquote(literal)
+			if err != nil {
+				t.Fatalf("goString(%q) = %s is not a Go string literal: %v", tt.s, literal, err)
+			}
+			if got != tt.s {
+				t.Errorf("goString(%q) = %s, which is %q", tt.s, literal, got)
+			}
+		})
+	}
+	if got := goString("a\nb"); got != "`a\nb`" {
+		t.Errorf("multi-line body = %s, want a raw string", got)
+	}
+	if got := goString("a\r\nb"); !strings.HasPrefix(got, `"`) {
+		t.Errorf("carriage return = %s, want an interpreted string as a raw string drops it", got)
+	}
+}
+
+func TestHTTPieEscape(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", "plain"},
+		{`a\b`, `a\\b`},
+		{`a\:b`, `a\\:b`},
+		{"it's", "it's"},
+	}
+	for _, tt := range tests {
+		if got := httpieEscape(tt.value); got != tt.want {
+			t.Errorf("httpieEscape(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCurlReproduction(t *testing.T) {
+	tests := []struct {
+		name string
+		rep  reproduction
+		want string
+	}{
+		{
+			name: "GET",
+			rep:  reproduction{method: http.MethodGet, url: "https://example.test/"},
+			want: "curl \\\n  https://example.test/",
+		},
+		{
+			name: "HEAD",
+			rep:  reproduction{method: http.MethodHead, url: "https://example.test/"},
+			want: "curl --head \\\n  https://example.test/",
+		},
+		{
+			name: "body",
+			rep:  reproduction{method: http.MethodPost, url: "https://example.test/", body: []byte(`{"a":"it's"}`)},
+			want: "curl -X POST \\\n  --data-binary '{\"a\":\"it'\\''s\"}' \\\n  https://example.test/",
+		},
+		{
+			name: "body starting with @",
+			rep:  reproduction{method: http.MethodPost, url: "https://example.test/", body: []byte("@file")},
+			want: "curl -X POST \\\n  --data-raw @file \\\n  https://example.test/",
+		},
+		{
+			name: "empty header",
+			rep:  reproduction{method: http.MethodGet, url: "https://example.test/", headers: http.Header{"X-Empty": {""}}},
+			want: "curl \\\n  -H 'X-Empty;' \\\n  https://example.test/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rep.curl(); got != tt.want {
+				t.Errorf("curl =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryTransport retries requests which failed to connect, whose connection was dropped, or which got a 429 or 503.
+// Only idempotent requests and requests whose body can be replayed with GetBody are retried.
+// Every retry is logged with the attempt number and the reason. When it wraps a LoggingTransport
+// (see WithRetryRoundTripper) the records of each attempt also carry the attempt number.
+type RetryTransport struct {
+	rt          http.RoundTripper
+	logger      *slog.Logger
+	redactor    Redactor
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+func NewRetryTransport(options ...RetryOption) *RetryTransport {
+	t := &RetryTransport{
+		rt:          http.DefaultTransport,
+		logger:      slog.Default(),
+		redactor:    DefaultRedactor(),
+		maxAttempts: 3,
+		baseDelay:   100 * time.Millisecond,
+		maxDelay:    10 * time.Second,
+	}
+
+	for _, option := range options {
+		option(t)
+	}
+
+	return t
+}
+
+type RetryOption func(transport *RetryTransport)
+
+func WithRetryRoundTripper(rt http.RoundTripper) RetryOption {
+	return func(t *RetryTransport) {
+		t.rt = rt
+	}
+}
+
+func WithRetryLogger(logger *slog.Logger) RetryOption {
+	return func(t *RetryTransport) {
+		t.logger = logger
+	}
+}
+
+// WithRetryRedactor sets the redaction policy for the URL in the retry logs
+func WithRetryRedactor(redactor Redactor) RetryOption {
+	return func(t *RetryTransport) {
+		t.redactor = redactor
+	}
+}
+
+// WithMaxAttempts sets how many times the request is sent at most, including the first attempt
+func WithMaxAttempts(attempts int) RetryOption {
+	return func(t *RetryTransport) {
+		t.maxAttempts = attempts
+	}
+}
+
+// WithBackoff sets the delay before the first retry, it doubles with every attempt up to maxDelay.
+// A response whose Retry-After is longer than maxDelay is returned to the caller instead of being retried.
+func WithBackoff(baseDelay, maxDelay time.Duration) RetryOption {
+	return func(t *RetryTransport) {
+		t.baseDelay = baseDelay
+		t.maxDelay = maxDelay
+	}
+}
+
+type attemptKey struct{}
+
+// attemptFromContext returns the number of the attempt set by RetryTransport, 0 if the request is not retried
+func attemptFromContext(ctx context.Context) int {
+	attempt, _ := ctx.Value(attemptKey{}).(int)
+	return attempt
+}
+
+func (t *RetryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rCtx := r.Context()
+	if !retryable(r) {
+		return t.rt.RoundTrip(r)
+	}
+
+	methodAttr := slog.String("method", r.Method)
+	urlAttr := slog.String("url", t.redactor.RedactURL(r.URL))
+
+	for attempt := 1; ; attempt++ {
+		req := r.WithContext(context.WithValue(rCtx, attemptKey{}, attempt))
+		if attempt > 1 && r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := t.rt.RoundTrip(req)
+
+		reason := retryReason(rCtx, resp, err)
+		if reason == "" || attempt >= t.maxAttempts {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				// retrying before the server asked for is bound to fail again, the caller gets the response instead
+				if retryAfter > t.maxDelay {
+					t.logger.InfoContext(rCtx, "not retrying request", methodAttr, urlAttr, slog.Int("attempt", attempt), slog.String("reason", reason), slog.Duration("retry_after", retryAfter))
+					return resp, nil
+				}
+				delay = retryAfter
+			}
+			// drain the body so the connection can be reused
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		t.logger.InfoContext(rCtx, "retrying request", methodAttr, urlAttr, slog.Int("attempt", attempt), slog.String("reason", reason), slog.Duration("delay", delay))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-rCtx.Done():
+			timer.Stop()
+			return nil, rCtx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the exponential delay with full jitter for the attempt
+func (t *RetryTransport) backoff(attempt int) time.Duration {
+	delay := t.maxDelay
+	if shift := attempt - 1; shift < 32 {
+		delay = min(t.baseDelay<<shift, t.maxDelay)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return rand.N(delay) + 1
+}
+
+// retryable reports whether the request may be sent again
+func retryable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+	}
+	return r.GetBody != nil
+}
+
+// retryReason returns why the attempt should be retried, or an empty string if it should not be
+func retryReason(ctx context.Context, resp *http.Response, err error) string {
+	if err != nil {
+		if ctx.Err() != nil || !retryableError(ctx, err) {
+			return ""
+		}
+		return "connection error: " + err.Error()
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return "status " + resp.Status
+	}
+	return ""
+}
+
+// retryableError reports whether the connection failed, when dialing or because the server dropped it.
+// Other errors such as a certificate verification failure, ErrCircuitOpen, ErrLimitQueueFull or ErrNoInteraction
+// would fail the same way again, and retrying ErrCircuitOpen would defeat the circuit breaker.
+func retryableError(ctx context.Context, err error) bool {
+	switch classifyError(ctx, err) {
+	case ErrorTypeConnectionRefused, ErrorTypeResetByPeer:
+		return true
+	case ErrorTypeOther, ErrorTypeTimeout:
+		var opErr *net.OpError
+		return (errors.As(err, &opErr) && opErr.Op == "dial") || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	return false
+}
+
+// parseRetryAfter parses Retry-After given either in seconds or as a HTTP date
+// See https://www.rfc-editor.org/rfc/rfc9110#field.retry-after
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(time.Until(date), 0), true
+}
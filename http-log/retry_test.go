@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer answers 503 with retryAfter to the first failures requests, then 200,
+// it returns the bodies of the requests it got
+func flakyServer(t *testing.T, failures int, retryAfter string) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		n := len(bodies)
+		mu.Unlock()
+		if n <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), bodies...)
+	}
+}
+
+func TestRetryServiceUnavailable(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		wantStatus int
+		wantCalls  int
+		minElapsed time.Duration
+	}{
+		{"backoff", "", http.StatusOK, 3, 0},
+		{"retry-after within max delay", "1", http.StatusOK, 3, 2 * time.Second},
+		{"retry-after beyond max delay", "120", http.StatusServiceUnavailable, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, bodies := flakyServer(t, 2, tt.retryAfter)
+			client := &http.Client{Transport: NewRetryTransport(
+				WithRetryLogger(discardLogger()),
+				WithMaxAttempts(3),
+				WithBackoff(time.Millisecond, 10*time.Second),
+			)}
+
+			// POST is not idempotent, it is retried because NewRequest sets GetBody for a strings.Reader
+			start := time.Now()
+			resp, err := client.Post(srv.URL, "text/plain", strings.NewReader("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			elapsed := time.Since(start)
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			got := bodies()
+			if len(got) != tt.wantCalls {
+				t.Fatalf("server got %d requests, want %d", len(got), tt.wantCalls)
+			}
+			for i, body := range got {
+				if body != "payload" {
+					t.Errorf("body of attempt %d = %q, want the replayed payload", i+1, body)
+				}
+			}
+			if elapsed < tt.minElapsed {
+				t.Errorf("retried after %v, want at least the %v asked by Retry-After", elapsed, tt.minElapsed)
+			}
+			if tt.wantCalls == 1 && elapsed > time.Second {
+				t.Errorf("gave up after %v, want the response right away", elapsed)
+			}
+		})
+	}
+}
+
+func TestRetryNotReplayable(t *testing.T) {
+	srv, bodies := flakyServer(t, 2, "")
+	client := &http.Client{Transport: NewRetryTransport(WithRetryLogger(discardLogger()), WithBackoff(time.Millisecond, time.Millisecond))}
+
+	// without GetBody the body of a POST can't be sent again
+	r, _ := http.NewRequest(http.MethodPost, srv.URL, io.NopCloser(strings.NewReader("payload")))
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || len(bodies()) != 1 {
+		t.Errorf("status = %d after %d requests, want a single 503", resp.StatusCode, len(bodies()))
+	}
+}
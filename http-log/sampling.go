@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LogPolicy decides, once the response arrived, whether the records of the exchange are emitted
+type LogPolicy interface {
+	ShouldLog(reqInfo *requestInfo) bool
+}
+
+// LogPolicyFunc is an adapter to allow the use of ordinary functions as LogPolicy
+type LogPolicyFunc func(reqInfo *requestInfo) bool
+
+func (f LogPolicyFunc) ShouldLog(reqInfo *requestInfo) bool {
+	return f(reqInfo)
+}
+
+// WithLogPolicy holds back the records of every exchange until the policy decided whether to emit them.
+// The number of dropped exchanges per host is logged every summaryInterval, and a last time by Close.
+func WithLogPolicy(policy LogPolicy, summaryInterval time.Duration) Option {
+	return func(t *LoggingTransport) {
+		t.logPolicy = policy
+		t.dropped = newDroppedLogs(summaryInterval)
+	}
+}
+
+// SamplingPolicy always logs transport errors, 5xx responses and requests slower than SlowThreshold,
+// other requests are logged at most PerHostPerSecond times per second for every host
+type SamplingPolicy struct {
+	SlowThreshold    time.Duration
+	PerHostPerSecond int
+
+	mu      sync.Mutex
+	windows map[string]*sampleWindow
+}
+
+type sampleWindow struct {
+	second int64
+	count  int
+}
+
+func NewSamplingPolicy(slowThreshold time.Duration, perHostPerSecond int) *SamplingPolicy {
+	return &SamplingPolicy{
+		SlowThreshold:    slowThreshold,
+		PerHostPerSecond: perHostPerSecond,
+		windows:          make(map[string]*sampleWindow),
+	}
+}
+
+func (p *SamplingPolicy) ShouldLog(reqInfo *requestInfo) bool {
+	if reqInfo.ResponseErr != nil || reqInfo.ResponseStatusCode >= http.StatusInternalServerError {
+		return true
+	}
+	if p.SlowThreshold > 0 && reqInfo.Duration > p.SlowThreshold {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	host := reqInfo.requestURL.Host
+	second := time.Now().Unix()
+	if p.windows == nil {
+		// the policy may be built as a struct literal instead of with NewSamplingPolicy
+		p.windows = make(map[string]*sampleWindow)
+	}
+	w, ok := p.windows[host]
+	if !ok {
+		w = &sampleWindow{}
+		p.windows[host] = w
+	}
+	if w.second != second {
+		w.second = second
+		w.count = 0
+	}
+	if w.count >= p.PerHostPerSecond {
+		return false
+	}
+	w.count++
+	return true
+}
+
+// droppedLogs counts the exchanges whose records were dropped by the LogPolicy
+type droppedLogs struct {
+	interval time.Duration
+
+	mu          sync.Mutex
+	lastSummary time.Time
+	hosts       map[string]int64
+}
+
+func newDroppedLogs(interval time.Duration) *droppedLogs {
+	return &droppedLogs{
+		interval:    interval,
+		lastSummary: time.Now(),
+		hosts:       make(map[string]int64),
+	}
+}
+
+func (d *droppedLogs) add(host string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.hosts[host]++
+}
+
+// logSummary logs and resets the counters, unless no exchange was dropped since the previous summary
+func (d *droppedLogs) logSummary(ctx context.Context, logger *slog.Logger) {
+	d.mu.Lock()
+	if len(d.hosts) == 0 {
+		d.mu.Unlock()
+		return
+	}
+	hosts := d.hosts
+	since := d.lastSummary
+	d.hosts = make(map[string]int64)
+	d.lastSummary = time.Now()
+	d.mu.Unlock()
+
+	var total int64
+	var perHost []any
+	for host, count := range hosts {
+		total += count
+		perHost = append(perHost, slog.Int64(host, count))
+	}
+	logger.InfoContext(ctx, "dropped request logs", slog.Int64("total", total), slog.Time("since", since), slog.Group("hosts", perHost...))
+}
+
+// exchangeLogger emits the records of a single exchange.
+// When deferred the records are kept until decide is called, then they are either emitted or dropped.
+type exchangeLogger struct {
+	logger *slog.Logger
+	attrs  []slog.Attr
+	muted  bool // only the single exchange event is emitted
+
+	minLevel slog.Leveler // records below are dropped, nil keeps all of them
+
+	mu       sync.Mutex
+	deferred bool
+	drop     bool
+	records  []slog.Record
+}
+
+func newExchangeLogger(logger *slog.Logger, deferred bool) *exchangeLogger {
+	return &exchangeLogger{logger: logger, deferred: deferred}
+}
+
+// with adds attributes to every record of the exchange, it must be called before the first record is logged
+func (l *exchangeLogger) with(attrs ...slog.Attr) {
+	l.attrs = append(l.attrs, attrs...)
+}
+
+func (l *exchangeLogger) Log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	if l.muted || !l.enabled(ctx, level) {
+		return
+	}
+	r := slog.NewRecord(time.Now(), level, msg, 0)
+	r.Add(args...)
+	l.handle(ctx, r)
+}
+
+func (l *exchangeLogger) LogAttrs(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
+	if l.muted {
+		return
+	}
+	l.event(ctx, level, msg, attrs...)
+}
+
+// event logs the record even when the split records are muted
+func (l *exchangeLogger) event(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
+	if !l.enabled(ctx, level) {
+		return
+	}
+	r := slog.NewRecord(time.Now(), level, msg, 0)
+	r.AddAttrs(attrs...)
+	l.handle(ctx, r)
+}
+
+func (l *exchangeLogger) enabled(ctx context.Context, level slog.Level) bool {
+	if l.minLevel != nil && level < l.minLevel.Level() {
+		return false
+	}
+	return l.logger.Enabled(ctx, level)
+}
+
+func (l *exchangeLogger) handle(ctx context.Context, r slog.Record) {
+	r.AddAttrs(l.attrs...)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.drop {
+		return
+	}
+	if l.deferred {
+		l.records = append(l.records, r)
+		return
+	}
+	_ = l.logger.Handler().Handle(ctx, r)
+}
+
+// decide emits or drops the records held back so far, later records follow the same decision
+func (l *exchangeLogger) decide(ctx context.Context, emit bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records := l.records
+	l.records = nil
+	l.deferred = false
+	l.drop = !emit
+	if !emit {
+		return
+	}
+	for _, r := range records {
+		_ = l.logger.Handler().Handle(ctx, r)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSummaryClient returns a client dropping every exchange and counting the connections,
+// the summaries are logged into the returned buffer
+func newSummaryClient(t *testing.T, interval time.Duration) (*http.Client, *LoggingTransport, *syncBuffer) {
+	t.Helper()
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	transport := NewLoggingTransport(
+		WithLogger(logger),
+		WithRoundTripper(http.DefaultTransport.(*http.Transport).Clone()),
+		WithLogPolicy(LogPolicyFunc(func(*requestInfo) bool { return false }), interval),
+		WithPoolStats(interval),
+	)
+	t.Cleanup(func() { _ = transport.Close() })
+	return &http.Client{Transport: transport}, transport, &logs
+}
+
+func summaryServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSummariesWithoutTraffic(t *testing.T) {
+	srv := summaryServer(t)
+	client, _, logs := newSummaryClient(t, 20*time.Millisecond)
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+
+	// no other request is sent, the ticker logs the summaries
+	out := logs.waitFor(t, "connection pool summary")
+	out = logs.waitFor(t, "dropped request logs")
+	if strings.Contains(out, `msg=response`) {
+		t.Errorf("the dropped exchange is logged:\n%s", out)
+	}
+	if !strings.Contains(out, "total=1") {
+		t.Errorf("dropped summary does not count the exchange:\n%s", out)
+	}
+
+	// an idle interval logs nothing
+	time.Sleep(100 * time.Millisecond)
+	out = logs.String()
+	if n := strings.Count(out, "dropped request logs"); n != 1 {
+		t.Errorf("dropped summary logged %d times, want once:\n%s", n, out)
+	}
+	if n := strings.Count(out, "connection pool summary"); n != 1 {
+		t.Errorf("pool summary logged %d times, want once:\n%s", n, out)
+	}
+}
+
+func TestSummariesOnClose(t *testing.T) {
+	srv := summaryServer(t)
+	client, transport, logs := newSummaryClient(t, time.Hour)
+
+	for range 2 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, resp)
+	}
+	if out := logs.String(); strings.Contains(out, "summary") || strings.Contains(out, "dropped request logs") {
+		t.Fatalf("summary logged before the interval:\n%s", out)
+	}
+
+	if err := transport.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out := logs.String()
+	if !strings.Contains(out, "dropped request logs") || !strings.Contains(out, "total=2") {
+		t.Errorf("Close does not log the dropped exchanges of the last interval:\n%s", out)
+	}
+	if !strings.Contains(out, "new=1 ") || !strings.Contains(out, "reused=1 ") {
+		t.Errorf("Close does not log the pool counters:\n%s", out)
+	}
+	// closing twice is harmless
+	if err := transport.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
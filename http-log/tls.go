@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// tlsAttrs describes the negotiated TLS connection and the certificate presented by the server
+func tlsAttrs(state tls.ConnectionState) []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("version", tls.VersionName(state.Version)),
+		slog.String("cipher_suite", tls.CipherSuiteName(state.CipherSuite)),
+		slog.String("alpn", state.NegotiatedProtocol),
+		slog.String("sni", state.ServerName),
+		slog.Bool("resumed", state.DidResume),
+	}
+	if len(state.PeerCertificates) == 0 {
+		return attrs
+	}
+
+	leaf := state.PeerCertificates[0]
+	sans := make([]string, 0, len(leaf.DNSNames)+len(leaf.IPAddresses))
+	sans = append(sans, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	attrs = append(attrs,
+		slog.String("subject", leaf.Subject.String()),
+		slog.String("issuer", leaf.Issuer.String()),
+		slog.Any("sans", sans),
+		slog.Time("not_after", leaf.NotAfter),
+		slog.Int("days_until_expiry", int(time.Until(leaf.NotAfter).Hours()/24)),
+	)
+	return attrs
+}
+
+// classifyTLSError returns the kind of certificate problem behind a failed handshake
+func classifyTLSError(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "unknown_authority"
+	case errors.As(err, &hostname):
+		return "hostname_mismatch"
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return "expired"
+	case errors.As(err, &invalid):
+		return "invalid_certificate"
+	}
+	return "handshake_failure"
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/http/httptrace"
+	"net/textproto"
+	"time"
+)
+
+// dnsAttempt is a single DNS lookup made for the request
+type dnsAttempt struct {
+	Host     string
+	Addrs    []string
+	Duration time.Duration
+	Err      error
+}
+
+// dialAttempt is a single dial made for the request, with Happy Eyeballs several of them race each other
+type dialAttempt struct {
+	Network  string
+	Addr     string
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+	done     bool
+}
+
+// informationalResponse is a 1xx response received before the final one
+type informationalResponse struct {
+	Code  int
+	Since time.Duration // since the start of the request
+}
+
+// clientTrace returns the hooks which collect the timing of the request phases into requestInfo.
+// All the state is kept in requestInfo behind muTrace, the hooks can be called concurrently
+// and some of them, e.g. a dial which lost the race, even after RoundTrip returned.
+func (t *LoggingTransport) clientTrace(ctx context.Context, elog *exchangeLogger, reqInfo *requestInfo) *httptrace.ClientTrace {
+	var getConn, gotConn, dnsStart, tlsStart, serverStart time.Time
+	var host string
+
+	return &httptrace.ClientTrace{
+		// DNS
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			reqInfo.muTrace.Lock()
+			defer reqInfo.muTrace.Unlock()
+			dnsStart = time.Now()
+			host = info.Host
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			reqInfo.muTrace.Lock()
+			defer reqInfo.muTrace.Unlock()
+			addrs := make([]string, 0, len(info.Addrs))
+			for _, addr := range info.Addrs {
+				addrs = append(addrs, addr.String())
+			}
+			lookup := dnsAttempt{Host: host, Addrs: addrs, Duration: time.Since(dnsStart), Err: info.Err}
+			reqInfo.DNSAttempts = append(reqInfo.DNSAttempts, lookup)
+			reqInfo.DNSLookup = lookup.Duration
+			if !t.detailedTiming {
+				return
+			}
+			elog.Log(ctx, t.detailedTimingLevel, "HTTP Trace", slog.String("DNS_lookup", host), slog.String("resolved", fmt.Sprintf("%v", info.Addrs)))
+		},
+		// Dial, with Happy Eyeballs IPv4 and IPv6 dials run at the same time
+		ConnectStart: func(network, addr string) {
+			if t.pool != nil {
+				t.pool.dialStart(reqInfo.requestURL.Host)
+			}
+			reqInfo.muTrace.Lock()
+			defer reqInfo.muTrace.Unlock()
+			reqInfo.DialAttempts = append(reqInfo.DialAttempts, dialAttempt{Network: network, Addr: addr, Start: time.Now()})
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if t.pool != nil {
+				t.pool.dialDone(reqInfo.requestURL.Host, err)
+			}
+			reqInfo.muTrace.Lock()
+			defer reqInfo.muTrace.Unlock()
+			for i := range reqInfo.DialAttempts {
+				dial := &reqInfo.DialAttempts[i]
+				if dial.done || dial.Network != network || dial.Addr != addr {
+					continue
+				}
+				dial.done = true
+				dial.Duration = time.Since(dial.Start)
+				dial.Err = err
+				if err == nil || reqInfo.Dialing == 0 {
+					reqInfo.Dialing = dial.Duration
+				}
+				break
+			}
+			if !t.detailedTiming {
+				return
+			}
+			if err != nil {
+				elog.Log(ctx, t.detailedTimingLevel, "HTTP Trace: Dial failed", slog.String("network", network), slog.String("addr", addr), slog.Any("error", err))
+			} else {
+				elog.Log(ctx, t.detailedTimingLevel, "HTTP Trace: Dial succeed", slog.String("network", network), slog.String("addr", addr))
+			}
+		},
+		// TLS
+		TLSHandshakeStart: func() {
+			reqInfo.muTrace.Lock()
+			defer reqInfo.muTrace.Unlock()
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			reqInfo.muTrace.Lock()
+			defer reqInfo.muTrace.Unlock()
+			reqInfo.TLSHandshake = time.Since(tlsStart)
+			reqInfo.TLSState = &state
+			reqInfo.TLSErr = err
+			if !t.detailedTiming {
+				return
+			}
+			if err != nil {
+				elog.LogAttrs(ctx, t.detailedTimingLevel, "HTTP Trace: TLS handshake failed", slog.String("sni", state.ServerName), slog.String("error_class", classifyTLSError(err)), slog.Any("error", err))
+			} else {
+				elog.LogAttrs(ctx, t.detailedTimingLevel, "HTTP Trace: TLS handshake", tlsAttrs(state)...)
+			}
+		},
+		// Connection (it can be DNS + Dial or just the time to get one from the connection pool)
+		GetConn: func(hostPort string) {
+			reqInfo.muTrace.Lock()
+			defer reqInfo.muTrace.Unlock()
+			getConn = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if t.pool != nil {
+				t.pool.gotConn(reqInfo.requestURL.Host, info)
+			}
+			reqInfo.muTrace.Lock()
+			defer reqInfo.muTrace.Unlock()
+			gotConn = time.Now()
+			reqInfo.GetConnection = gotConn.Sub(getConn)
+			reqInfo.ConnectionReused = info.Reused
+		},
+		// Expect: 100-continue
+		Wait100Continue: func() {
+			reqInfo.muTrace.Lock()
+			defer reqInfo.muTrace.Unlock()
+			reqInfo.Waited100Continue = true
+		},
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			reqInfo.muTrace.Lock()
+			defer reqInfo.muTrace.Unlock()
+			reqInfo.Informational = append(reqInfo.Informational, informationalResponse{Code: code, Since: time.Since(reqInfo.StartTime)})
+			return nil
+		},
+		// Server Processing (time since we wrote the request until first byte is received)
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			reqInfo.muTrace.Lock()
+			defer reqInfo.muTrace.Unlock()
+			serverStart = time.Now()
+			if !gotConn.IsZero() {
+				reqInfo.SendRequest = serverStart.Sub(gotConn)
+			}
+		},
+		GotFirstResponseByte: func() {
+			reqInfo.muTrace.Lock()
+			defer reqInfo.muTrace.Unlock()
+			// with Expect: 100-continue the first byte arrives before the body is written
+			if !serverStart.IsZero() {
+				reqInfo.ServerProcessing = time.Since(serverStart)
+			}
+		},
+	}
+}
+
+// statistics returns the attributes of the "HTTP statistics" record including every DNS lookup, dial and 1xx response
+func (r *requestInfo) statistics() []slog.Attr {
+	r.muTrace.Lock()
+	defer r.muTrace.Unlock()
+
+	var stats []slog.Attr
+	if r.QueueWait != 0 {
+		stats = append(stats, slog.Int64("QueueWait_ms", r.QueueWait.Milliseconds()))
+	}
+	if !r.ConnectionReused {
+		stats = append(stats, slog.Int64("DNSLookup_ms", r.DNSLookup.Nanoseconds()/int64(time.Millisecond)))
+		stats = append(stats, slog.Int64("Dial_ms", r.Dialing.Nanoseconds()/int64(time.Millisecond)))
+		stats = append(stats, slog.Int64("TLSHandshake_ms", r.TLSHandshake.Nanoseconds()/int64(time.Millisecond)))
+	} else {
+		stats = append(stats, slog.Int64("GetConnection_ms", r.GetConnection.Nanoseconds()/int64(time.Millisecond)))
+	}
+	if r.ServerProcessing != 0 {
+		stats = append(stats, slog.Int64("ServerProcessing_ms", r.ServerProcessing.Nanoseconds()/int64(time.Millisecond)))
+	}
+	stats = append(stats, slog.Int64("Duration_ms", r.Duration.Nanoseconds()/int64(time.Millisecond)))
+
+	// a single failed or slow attempt is listed as well, so its address and outcome are known
+	for i, lookup := range r.DNSAttempts {
+		stats = append(stats, slog.Group(fmt.Sprintf("DNS_%d", i+1),
+			slog.String("host", lookup.Host),
+			slog.String("outcome", outcome(lookup.Err, true)),
+			slog.Int64("ms", lookup.Duration.Milliseconds()),
+		))
+	}
+	for i, dial := range r.DialAttempts {
+		stats = append(stats, slog.Group(fmt.Sprintf("Dial_%d", i+1),
+			slog.String("network", dial.Network),
+			slog.String("addr", dial.Addr),
+			slog.String("outcome", outcome(dial.Err, dial.done)),
+			slog.Int64("ms", dial.Duration.Milliseconds()),
+		))
+	}
+	for i, info := range r.Informational {
+		stats = append(stats, slog.Group(fmt.Sprintf("Informational_%d", i+1),
+			slog.Int("status", info.Code),
+			slog.Int64("since_ms", info.Since.Milliseconds()),
+		))
+	}
+	if r.Waited100Continue {
+		stats = append(stats, slog.Bool("Wait100Continue", true))
+	}
+	return stats
+}
+
+// outcome describes the result of a traced attempt
+func outcome(err error, done bool) string {
+	switch {
+	case !done:
+		return "pending"
+	case err != nil:
+		return err.Error()
+	}
+	return "ok"
+}
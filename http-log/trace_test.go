@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestClientTraceConcurrentHooks calls the hooks from several goroutines as Happy Eyeballs and HTTP/2 do,
+// while the statistics are read, it is meant to be run with -race
+func TestClientTraceConcurrentHooks(t *testing.T) {
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	transport := NewLoggingTransport(WithLogger(logger), WithDetailedTiming(slog.LevelDebug))
+	r := httptest.NewRequest(http.MethodGet, "https://example.test/", nil)
+	reqInfo := newRequestInfo(r, transport.redactor)
+	ctx := context.Background()
+	trace := transport.clientTrace(ctx, newExchangeLogger(logger, false), reqInfo)
+
+	const dials = 20
+	refused := errors.New("connection refused")
+	var wg sync.WaitGroup
+	for i := range dials {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addr := fmt.Sprintf("192.0.2.%d:443", i+1)
+			trace.ConnectStart("tcp", addr)
+			var err error
+			if i%2 == 1 {
+				err = refused
+			}
+			trace.ConnectDone("tcp", addr, err)
+		}()
+	}
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		trace.DNSStart(httptrace.DNSStartInfo{Host: "example.test"})
+		trace.DNSDone(httptrace.DNSDoneInfo{Addrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}})
+	}()
+	go func() {
+		defer wg.Done()
+		trace.TLSHandshakeStart()
+		trace.TLSHandshakeDone(tls.ConnectionState{ServerName: "example.test"}, nil)
+	}()
+	go func() {
+		defer wg.Done()
+		trace.GetConn("example.test:443")
+		trace.GotConn(httptrace.GotConnInfo{})
+		trace.WroteRequest(httptrace.WroteRequestInfo{})
+		_ = trace.Got1xxResponse(http.StatusEarlyHints, nil)
+		trace.GotFirstResponseByte()
+	}()
+	go func() {
+		defer wg.Done()
+		for range dials {
+			_ = reqInfo.statistics()
+		}
+	}()
+	wg.Wait()
+
+	groups := make(map[string]slog.Value)
+	for _, attr := range reqInfo.statistics() {
+		groups[attr.Key] = attr.Value
+	}
+	for i := range dials {
+		dial, ok := groups[fmt.Sprintf("Dial_%d", i+1)]
+		if !ok {
+			t.Fatalf("Dial_%d is missing from the statistics %v", i+1, groups)
+		}
+		var addr, outcome string
+		for _, attr := range dial.Group() {
+			switch attr.Key {
+			case "addr":
+				addr = attr.Value.String()
+			case "outcome":
+				outcome = attr.Value.String()
+			}
+		}
+		var n int
+		if _, err := fmt.Sscanf(addr, "192.0.2.%d:443", &n); err != nil {
+			t.Fatalf("Dial_%d addr = %q: %v", i+1, addr, err)
+		}
+		if want := map[bool]string{true: "ok", false: refused.Error()}[n%2 == 1]; outcome != want {
+			t.Errorf("Dial_%d to %s outcome = %q, want %q", i+1, addr, outcome, want)
+		}
+	}
+	for _, key := range []string{"DNS_1", "Informational_1", "ServerProcessing_ms"} {
+		if _, ok := groups[key]; !ok {
+			t.Errorf("%s is missing from the statistics %v", key, groups)
+		}
+	}
+	if got := strings.Count(logs.String(), "HTTP Trace: Dial"); got != dials {
+		t.Errorf("%d dials are logged, want %d:\n%s", got, dials, logs.String())
+	}
+}
+
+// TestClientTraceConcurrentRequests sends requests in parallel over a shared HTTP/2 connection,
+// whose trace hooks run on the goroutines of the connection, it is meant to be run with -race
+func TestClientTraceConcurrentRequests(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		_, _ = io.WriteString(w, "ok")
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	client := &http.Client{Transport: NewLoggingTransport(
+		WithLogger(logger),
+		WithRoundTripper(srv.Client().Transport),
+		WithDetailedTiming(slog.LevelDebug),
+	)}
+
+	const requests = 20
+	var wg sync.WaitGroup
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if body := readBody(t, resp); body != "ok" {
+				t.Errorf("body = %q, want ok", body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	out := logs.String()
+	if got := strings.Count(out, `msg="HTTP statistics"`); got != requests {
+		t.Errorf("%d statistics are logged, want %d:\n%s", got, requests, out)
+	}
+	if got := strings.Count(out, "Informational_1.status=103"); got != requests {
+		t.Errorf("%d early hints are logged, want %d:\n%s", got, requests, out)
+	}
+}
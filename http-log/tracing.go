@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithTracing starts a client span for every round trip with the global TracerProvider and injects
+// the trace context into the request headers with the global TextMapPropagator.
+// The phases of the request are added to the span as events, the records of the exchange carry trace_id and span_id.
+func WithTracing() Option {
+	return func(t *LoggingTransport) {
+		t.tracing = true
+	}
+}
+
+// startSpan starts the client span and returns a copy of the request carrying the span and the propagated headers
+func (t *LoggingTransport) startSpan(r *http.Request) (*http.Request, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", r.Method),
+		attribute.String("url.full", t.redactor.RedactURL(r.URL)),
+	}
+	if host, port := serverAddress(r.URL); host != "" {
+		attrs = append(attrs, attribute.String("server.address", host))
+		if p, err := strconv.Atoi(port); err == nil {
+			attrs = append(attrs, attribute.Int("server.port", p))
+		}
+	}
+	if attempt := attemptFromContext(r.Context()); attempt > 1 {
+		attrs = append(attrs, attribute.Int("http.request.resend_count", attempt-1))
+	}
+
+	// the span name follows the HTTP semantic conventions, the method is low cardinality while the URL is not
+	ctx, span := otel.GetTracerProvider().Tracer("http-log").Start(r.Context(), r.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+
+	// the headers of the caller's request must not be modified
+	r = r.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
+	return r, span
+}
+
+// endSpan sets the outcome of the exchange on the span and ends it
+func endSpan(span trace.Span, reqInfo *requestInfo) {
+	if span == nil {
+		return
+	}
+	if reqInfo.ResponseErr != nil {
+		errorType := reqInfo.ErrorType
+		if errorType == "" {
+			errorType = ErrorTypeOther
+		}
+		span.SetAttributes(attribute.String("error.type", errorType))
+		span.RecordError(reqInfo.ResponseErr)
+		span.SetStatus(codes.Error, reqInfo.ResponseErr.Error())
+	} else {
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", reqInfo.ResponseStatusCode),
+			attribute.String("network.protocol.version", protocolVersion(reqInfo.ResponseProto)),
+		)
+		// client spans treat 4xx as errors as well
+		if reqInfo.ResponseStatusCode >= http.StatusBadRequest {
+			span.SetAttributes(attribute.String("error.type", strconv.Itoa(reqInfo.ResponseStatusCode)))
+			span.SetStatus(codes.Error, "")
+		}
+	}
+	span.End()
+}
+
+// spanTrace adds the phases of the request to the span as events, it's composed with the trace of clientTrace
+func spanTrace(span trace.Span) *httptrace.ClientTrace {
+	event := func(name string, attrs ...attribute.KeyValue) {
+		span.AddEvent(name, trace.WithAttributes(attrs...))
+	}
+	withError := func(attrs []attribute.KeyValue, err error) []attribute.KeyValue {
+		if err != nil {
+			attrs = append(attrs, attribute.String("error", err.Error()))
+		}
+		return attrs
+	}
+
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			event("http.get_conn", attribute.String("host_port", hostPort))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			event("http.got_conn", attribute.Bool("http.connection.reused", info.Reused))
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			event("http.dns.start", attribute.String("host", info.Host))
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			addrs := make([]string, 0, len(info.Addrs))
+			for _, addr := range info.Addrs {
+				addrs = append(addrs, addr.String())
+			}
+			event("http.dns.done", withError([]attribute.KeyValue{attribute.StringSlice("addrs", addrs)}, info.Err)...)
+		},
+		ConnectStart: func(network, addr string) {
+			event("http.connect.start", attribute.String("network", network), attribute.String("addr", addr))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			event("http.connect.done", withError([]attribute.KeyValue{attribute.String("network", network), attribute.String("addr", addr)}, err)...)
+		},
+		TLSHandshakeStart: func() {
+			event("http.tls.start")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			attrs := []attribute.KeyValue{attribute.String("tls.protocol.version", protocolVersion(tls.VersionName(state.Version)))}
+			event("http.tls.done", withError(attrs, err)...)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			event("http.wrote_request", withError(nil, info.Err)...)
+		},
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			event("http.informational_response", attribute.Int("http.response.status_code", code))
+			return nil
+		},
+		GotFirstResponseByte: func() {
+			event("http.first_response_byte")
+		},
+	}
+}
+
+// withSpanTrace attaches the span events trace to the context, next to the trace already in it
+func withSpanTrace(ctx context.Context, span trace.Span) context.Context {
+	if !span.IsRecording() {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, spanTrace(span))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// transferBody wraps a response body to measure the transfer of the whole body.
+// onComplete is called once, when the body hits EOF or when it's closed before that.
+// onLeak is called when the body is garbage collected without being closed.
+type transferBody struct {
+	rc        io.ReadCloser
+	headersAt time.Time
+
+	mu         sync.Mutex
+	bytes      int64
+	eof        bool
+	closed     bool
+	completed  bool
+	lastByteAt time.Time
+
+	onComplete func(stats transferStats)
+	onLeak     func(stats transferStats)
+}
+
+// transferStats describe how the response body was consumed
+type transferStats struct {
+	Bytes       int64
+	Transfer    time.Duration // from the response headers to the last byte
+	LastByteAt  time.Time
+	ClosedEarly bool
+	ReachedEOF  bool
+	// Completed is set when onComplete was already called, the body was read to EOF but not closed
+	Completed bool
+}
+
+// Throughput returns the transfer speed in bytes per second
+func (s transferStats) Throughput() float64 {
+	if s.Transfer <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Transfer.Seconds()
+}
+
+func newTransferBody(rc io.ReadCloser, onComplete, onLeak func(stats transferStats)) *transferBody {
+	b := &transferBody{
+		rc:         rc,
+		headersAt:  time.Now(),
+		onComplete: onComplete,
+		onLeak:     onLeak,
+	}
+	runtime.SetFinalizer(b, (*transferBody).leaked)
+	return b
+}
+
+func (b *transferBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+
+	b.mu.Lock()
+	b.bytes += int64(n)
+	if n > 0 {
+		b.lastByteAt = time.Now()
+	}
+	complete := false
+	if errors.Is(err, io.EOF) && !b.eof {
+		b.eof = true
+		complete = true
+	}
+	b.mu.Unlock()
+
+	if complete {
+		b.complete()
+	}
+	return n, err
+}
+
+func (b *transferBody) Close() error {
+	err := b.rc.Close()
+
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	runtime.SetFinalizer(b, nil)
+
+	b.complete()
+	return err
+}
+
+func (b *transferBody) stats() transferStats {
+	lastByteAt := b.lastByteAt
+	if lastByteAt.IsZero() {
+		lastByteAt = b.headersAt
+	}
+	return transferStats{
+		Bytes:       b.bytes,
+		Transfer:    lastByteAt.Sub(b.headersAt),
+		LastByteAt:  lastByteAt,
+		ClosedEarly: b.closed && !b.eof,
+		ReachedEOF:  b.eof,
+		Completed:   b.completed,
+	}
+}
+
+func (b *transferBody) complete() {
+	b.mu.Lock()
+	if b.completed {
+		b.mu.Unlock()
+		return
+	}
+	b.completed = true
+	stats := b.stats()
+	b.mu.Unlock()
+
+	b.onComplete(stats)
+}
+
+func (b *transferBody) leaked() {
+	b.mu.Lock()
+	stats := b.stats()
+	b.mu.Unlock()
+
+	b.onLeak(stats)
+}
+
+// trackTransfer wraps the response body to log the "response completed" record with the bytes read,
+// the time to the last byte and the throughput, or a warning when the body is never closed.
+// It returns a copy of the response, the original one is referenced by http.Transport until the body is closed
+// and it would keep the wrapper from being garbage collected.
+func (t *LoggingTransport) trackTransfer(ctx context.Context, elog *exchangeLogger, reqInfo *requestInfo, resp *http.Response, methodAttr, urlAttr slog.Attr) *http.Response {
+	if resp.Body == nil || resp.Body == http.NoBody || resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp
+	}
+	statusAttr := slog.String("status", resp.Status)
+	startTime := reqInfo.StartTime
+
+	reqInfo.transferTracked = true
+	tracked := *resp
+	tracked.Body = newTransferBody(resp.Body, func(stats transferStats) {
+		reqInfo.muTrace.Lock()
+		reqInfo.BytesRead = stats.Bytes
+		reqInfo.TimeToLastByte = stats.LastByteAt.Sub(startTime)
+		reqInfo.ClosedEarly = stats.ClosedEarly
+		reqInfo.muTrace.Unlock()
+		if t.singleEvent {
+			t.logEvent(ctx, elog, reqInfo)
+		}
+		if t.har != nil {
+			t.recordHAR(ctx, reqInfo, methodAttr, urlAttr)
+		}
+
+		elog.LogAttrs(ctx, slog.LevelInfo, "response completed", methodAttr, urlAttr, statusAttr,
+			slog.Int64("bytes", stats.Bytes),
+			slog.Int64("TimeToLastByte_ms", stats.LastByteAt.Sub(startTime).Milliseconds()),
+			slog.Int64("Transfer_ms", stats.Transfer.Milliseconds()),
+			slog.Float64("throughput_Bps", stats.Throughput()),
+			slog.Bool("closed_early", stats.ClosedEarly),
+		)
+	}, func(stats transferStats) {
+		// the event was already logged when the body reached EOF
+		if t.singleEvent && !stats.Completed {
+			reqInfo.muTrace.Lock()
+			reqInfo.BytesRead = stats.Bytes
+			reqInfo.muTrace.Unlock()
+			t.logEvent(ctx, elog, reqInfo)
+		}
+		if t.har != nil && !stats.Completed {
+			t.recordHAR(ctx, reqInfo, methodAttr, urlAttr)
+		}
+		elog.event(ctx, slog.LevelWarn, "response body leaked", methodAttr, urlAttr, statusAttr,
+			slog.Int64("bytes", stats.Bytes),
+			slog.Bool("reached_eof", stats.ReachedEOF),
+		)
+	})
+	return &tracked
+}